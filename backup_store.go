@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Backup stores available for the configuration backups and history.
+const (
+	// BackupStoreTags keeps the backups in tags of the volumes.
+	BackupStoreTags = "tags"
+	// BackupStoreFile keeps the backups in a local NDJSON file.
+	BackupStoreFile = "file"
+	// BackupStoreS3 keeps the backups in NDJSON objects stored in an
+	// S3-compatible bucket, one object per volume.
+	BackupStoreS3 = "s3"
+)
+
+// backupStore persists the configurations of the volumes backed up before
+// modifying them, which are then used for rolling them back. The keys are
+// InitialConfigurationTag and PreviousConfigurationTag.
+type backupStore interface {
+	save(v *EBSVolume, key string, vc *volumeConfig) error
+
+	// load returns nil without an error when there's no backup for the key.
+	load(v *EBSVolume, key string) (*volumeConfig, error)
+}
+
+// backups is the store used for the configuration backups of the volumes, set
+// up by Init.
+var backups backupStore
+
+// setupBackupStore sets up the configured backup store, which also keeps the
+// configuration history unless the backups are stored in tags. The other
+// stores fall back to the backups previously stored in tags.
+func setupBackupStore(c *Config) error {
+
+	switch c.BackupStore {
+	case BackupStoreTags, "":
+		backups, history = tagBackupStore{}, newTagHistoryStore(c.HistorySize)
+	case BackupStoreFile:
+		s, err := newFileBackupStore(c.BackupFile)
+		if err != nil {
+			return err
+		}
+		backups, history = tagFallbackStore{s}, s
+	case BackupStoreS3:
+		s, err := newS3BackupStore(c)
+		if err != nil {
+			return err
+		}
+		backups, history = tagFallbackStore{s}, s
+	default:
+		return fmt.Errorf("unknown backup store %q", c.BackupStore)
+	}
+
+	log.Println("Using the backup store:", c.BackupStore)
+	return nil
+}
+
+// tagBackupStore keeps each backup in a tag of the volume named after its key.
+type tagBackupStore struct{}
+
+func (tagBackupStore) save(v *EBSVolume, key string, vc *volumeConfig) error {
+	value := vc.toString()
+	debug.Printf("Configuration %v converted to string: %s\n", vc, value)
+	return v.writeTag(key, value)
+}
+
+func (tagBackupStore) load(v *EBSVolume, key string) (*volumeConfig, error) {
+	for _, tag := range v.Tags {
+		if aws.ToString(tag.Key) != key {
+			continue
+		}
+		var vc volumeConfig
+		if err := json.Unmarshal([]byte(aws.ToString(tag.Value)), &vc); err != nil {
+			return nil, fmt.Errorf("invalid %s tag: %w", key, err)
+		}
+		return &vc, nil
+	}
+	return nil, nil
+}
+
+// tagFallbackStore loads the backups missing from the wrapped store from the
+// tags of the volume, where they were kept by the executions preceding the
+// switch to that store. Otherwise the optimized configuration would later be
+// backed up as the initial one.
+type tagFallbackStore struct {
+	backupStore
+}
+
+func (s tagFallbackStore) load(v *EBSVolume, key string) (*volumeConfig, error) {
+	vc, err := s.backupStore.load(v, key)
+	if err != nil || vc != nil {
+		return vc, err
+	}
+	return tagBackupStore{}.load(v, key)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// backupRecord is a line of the NDJSON backup files and objects, holding
+// either a configuration backup or a configuration history entry.
+type backupRecord struct {
+	VolumeID string        `json:"volumeId"`
+	Region   string        `json:"region"`
+	Key      string        `json:"key"`
+	Time     time.Time     `json:"time"`
+	Config   *volumeConfig `json:"config,omitempty"`
+	History  *historyEntry `json:"history,omitempty"`
+}
+
+// historyRecordKey is the key of the records holding history entries.
+const historyRecordKey = "history"
+
+func newBackupRecord(v *EBSVolume, key string) backupRecord {
+	return backupRecord{
+		VolumeID: *v.VolumeId,
+		Region:   v.region,
+		Key:      key,
+		Time:     time.Now().UTC(),
+	}
+}
+
+// backupRecords are the records of a volume, in the order they were written.
+type backupRecords []backupRecord
+
+// latest returns the configuration from the last record with the given key.
+func (br backupRecords) latest(key string) *volumeConfig {
+	for i := len(br) - 1; i >= 0; i-- {
+		if br[i].Key == key && br[i].Config != nil {
+			vc := *br[i].Config
+			return &vc
+		}
+	}
+	return nil
+}
+
+func (br backupRecords) history() []historyEntry {
+	var entries []historyEntry
+	for _, r := range br {
+		if r.Key == historyRecordKey && r.History != nil {
+			entries = append(entries, *r.History)
+		}
+	}
+	return entries
+}
+
+// nextHistoryEntry sets the sequence number of the entry following the
+// existing history.
+func (br backupRecords) nextHistoryEntry(entry historyEntry) historyEntry {
+	entry.Seq = 1
+	if entries := br.history(); len(entries) > 0 {
+		entry.Seq = entries[len(entries)-1].Seq + 1
+	}
+	return entry
+}
+
+// readBackupRecords parses NDJSON records, skipping the empty lines.
+func readBackupRecords(r io.Reader) ([]backupRecord, error) {
+	var records []backupRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var record backupRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("invalid backup record on line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// fileBackupStore appends the records of all volumes to a local NDJSON file,
+// which is loaded in memory when setting up the store. In Lambda it should be
+// located on a persistent file system, such as EFS.
+type fileBackupStore struct {
+	path    string
+	records map[string]backupRecords
+	mutex   sync.Mutex
+}
+
+func newFileBackupStore(path string) (*fileBackupStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no backup file configured")
+	}
+
+	s := &fileBackupStore{path: path, records: make(map[string]backupRecords)}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		debug.Println("Backup file", path, "doesn't exist yet")
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := readBackupRecords(f)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the backup file %s: %w", path, err)
+	}
+	for _, r := range records {
+		s.records[r.VolumeID] = append(s.records[r.VolumeID], r)
+	}
+	debug.Printf("Loaded %d backup records from %s\n", len(records), path)
+	return s, nil
+}
+
+// write appends the record to the file and syncs it to disk, before adding it
+// to the records kept in memory.
+func (s *fileBackupStore) write(record backupRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	s.records[record.VolumeID] = append(s.records[record.VolumeID], record)
+	return nil
+}
+
+func (s *fileBackupStore) save(v *EBSVolume, key string, vc *volumeConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record := newBackupRecord(v, key)
+	record.Config = vc
+	return s.write(record)
+}
+
+func (s *fileBackupStore) load(v *EBSVolume, key string) (*volumeConfig, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.records[*v.VolumeId].latest(key), nil
+}
+
+// The file store also implements historyStore, keeping the whole history.
+
+func (s *fileBackupStore) list(v *EBSVolume) ([]historyEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.records[*v.VolumeId].history(), nil
+}
+
+func (s *fileBackupStore) append(v *EBSVolume, entry historyEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry = s.records[*v.VolumeId].nextHistoryEntry(entry)
+	record := newBackupRecord(v, historyRecordKey)
+	record.History = &entry
+	return s.write(record)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3API is the part of the S3 client used by the backup store, which can be
+// replaced with a fake.
+type s3API interface {
+	s3.ListObjectsV2APIClient
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// s3BackupStore keeps the records of each volume in an NDJSON object of an
+// S3-compatible bucket, which is rewritten when adding a record since objects
+// can't be appended to. A custom endpoint allows using other implementations
+// of the S3 API, such as MinIO.
+type s3BackupStore struct {
+	client s3API
+	bucket string
+	prefix string
+
+	// the records of the volumes read so far
+	cache map[string]backupRecords
+
+	// the volumes having an object, by region, listed once per region so that
+	// the volumes without backups don't cost a request each. The regions whose
+	// listing failed have a nil map.
+	objects map[string]map[string]bool
+
+	mutex sync.Mutex
+}
+
+func newS3BackupStore(c *Config) (*s3BackupStore, error) {
+	if c.BackupS3Bucket == "" {
+		return nil, fmt.Errorf("no backup bucket configured")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithRegion(c.MainRegion),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if c.BackupS3Endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(c.BackupS3Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	return &s3BackupStore{
+		client: client,
+		bucket: c.BackupS3Bucket,
+		prefix: c.BackupS3Prefix,
+		cache:  make(map[string]backupRecords),
+
+		objects: make(map[string]map[string]bool),
+	}, nil
+}
+
+func (s *s3BackupStore) objectKey(v *EBSVolume) string {
+	return path.Join(s.prefix, v.region, *v.VolumeId+".ndjson")
+}
+
+// listObjects lists the volumes having an object in the given region.
+func (s *s3BackupStore) listObjects(region string) (map[string]bool, error) {
+	prefix := path.Join(s.prefix, region) + "/"
+	objects := make(map[string]bool)
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range resp.Contents {
+			name := strings.TrimPrefix(aws.ToString(o.Key), prefix)
+			if id := strings.TrimSuffix(name, ".ndjson"); id != name && !strings.Contains(id, "/") {
+				objects[id] = true
+			}
+		}
+	}
+	debug.Printf("Found %d backup objects in s3://%s/%s\n", len(objects), s.bucket, prefix)
+	return objects, nil
+}
+
+// hasObject checks if the volume has an object, listing the objects of its
+// region on the first call. When the listing fails, the volumes are assumed
+// to have an object, which is then read anyway.
+func (s *s3BackupStore) hasObject(v *EBSVolume) bool {
+	s.mutex.Lock()
+	objects, listed := s.objects[v.region]
+	s.mutex.Unlock()
+
+	if !listed {
+		var err error
+		if objects, err = s.listObjects(v.region); err != nil {
+			log.Printf("Couldn't list the backup objects of %s, reading them one by one: %s\n", v.region, err.Error())
+		}
+		s.mutex.Lock()
+		s.objects[v.region] = objects
+		s.mutex.Unlock()
+	}
+	return objects == nil || objects[*v.VolumeId]
+}
+
+// fetch returns the records of the volume, reading them from the bucket unless
+// they were already read or the volume has no object.
+func (s *s3BackupStore) fetch(v *EBSVolume) (backupRecords, error) {
+	s.mutex.Lock()
+	records, cached := s.cache[*v.VolumeId]
+	s.mutex.Unlock()
+
+	if cached {
+		return records, nil
+	}
+
+	if !s.hasObject(v) {
+		s.mutex.Lock()
+		s.cache[*v.VolumeId] = nil
+		s.mutex.Unlock()
+		return nil, nil
+	}
+
+	key := s.objectKey(v)
+	resp, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		debug.Printf("No backup object s3://%s/%s yet\n", s.bucket, key)
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't read s3://%s/%s: %w", s.bucket, key, err)
+	} else {
+		defer resp.Body.Close()
+		if records, err = readBackupRecords(resp.Body); err != nil {
+			return nil, fmt.Errorf("couldn't read s3://%s/%s: %w", s.bucket, key, err)
+		}
+	}
+
+	s.mutex.Lock()
+	s.cache[*v.VolumeId] = records
+	s.mutex.Unlock()
+	return records, nil
+}
+
+// write rewrites the object of the volume with the new record appended.
+func (s *s3BackupStore) write(v *EBSVolume, record backupRecord) error {
+	records, err := s.fetch(v)
+	if err != nil {
+		return err
+	}
+	records = append(records[:len(records):len(records)], record)
+
+	var buf bytes.Buffer
+	for _, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	key := s.objectKey(v)
+	_, err = s.client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't write s3://%s/%s: %w", s.bucket, key, err)
+	}
+
+	s.mutex.Lock()
+	s.cache[*v.VolumeId] = records
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *s3BackupStore) save(v *EBSVolume, key string, vc *volumeConfig) error {
+	record := newBackupRecord(v, key)
+	record.Config = vc
+	return s.write(v, record)
+}
+
+func (s *s3BackupStore) load(v *EBSVolume, key string) (*volumeConfig, error) {
+	records, err := s.fetch(v)
+	if err != nil {
+		return nil, err
+	}
+	return records.latest(key), nil
+}
+
+// The S3 store also implements historyStore, keeping the whole history.
+
+func (s *s3BackupStore) list(v *EBSVolume) ([]historyEntry, error) {
+	records, err := s.fetch(v)
+	if err != nil {
+		return nil, err
+	}
+	return records.history(), nil
+}
+
+func (s *s3BackupStore) append(v *EBSVolume, entry historyEntry) error {
+	records, err := s.fetch(v)
+	if err != nil {
+		return err
+	}
+	entry = records.nextHistoryEntry(entry)
+	record := newBackupRecord(v, historyRecordKey)
+	record.History = &entry
+	return s.write(v, record)
+}
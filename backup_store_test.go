@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// testBackupStore is a store which also keeps the history, like the file and
+// S3 stores.
+type testBackupStore interface {
+	backupStore
+	historyStore
+}
+
+// checkBackupStore saves backups and history entries of two volumes, checking
+// that the second store, reading the same storage, loads them back.
+func checkBackupStore(t *testing.T, s, reopen func() testBackupStore) {
+	a, b := testVolume("gp2", 100, 300, 0), testVolume("io1", 200, 1000, 0)
+	b.VolumeId = aws.String("vol-b")
+
+	initial := &volumeConfig{VolumeType: "gp2", IOPS: 300}
+	previous := &volumeConfig{VolumeType: "gp3", IOPS: 3000, Throughput: 125}
+
+	store := s()
+	for _, err := range []error{
+		store.save(a, InitialConfigurationTag, initial),
+		store.save(a, PreviousConfigurationTag, initial),
+		store.save(a, PreviousConfigurationTag, previous),
+		store.append(a, historyEntry{Config: historyConfig{VolumeType: "gp2"}}),
+		store.append(a, historyEntry{Config: historyConfig{VolumeType: "gp3"}}),
+		store.append(b, historyEntry{Config: historyConfig{VolumeType: "io1"}}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, store := range map[string]testBackupStore{"same store": store, "reopened store": reopen()} {
+		t.Run(name, func(t *testing.T) {
+			if vc, err := store.load(a, InitialConfigurationTag); err != nil || vc == nil || *vc != *initial {
+				t.Errorf("initial configuration %+v, %v, want %+v", vc, err, initial)
+			}
+			if vc, err := store.load(a, PreviousConfigurationTag); err != nil || vc == nil || *vc != *previous {
+				t.Errorf("previous configuration %+v, %v, want the latest one %+v", vc, err, previous)
+			}
+			if vc, err := store.load(b, InitialConfigurationTag); err != nil || vc != nil {
+				t.Errorf("initial configuration %+v, %v of a volume without backups", vc, err)
+			}
+
+			entries, err := store.list(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 || entries[0].Seq != 1 || entries[1].Seq != 2 || entries[1].Config.VolumeType != "gp3" {
+				t.Errorf("history %+v, want the gp2 and gp3 entries numbered from 1", entries)
+			}
+			if entries, err := store.list(b); err != nil || len(entries) != 1 || entries[0].Seq != 1 {
+				t.Errorf("history %+v, %v, want a single entry", entries, err)
+			}
+		})
+	}
+}
+
+func TestFileBackupStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backups.ndjson")
+
+	open := func() testBackupStore {
+		s, err := newFileBackupStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	checkBackupStore(t, open, open)
+}
+
+func TestFileBackupStoreErrors(t *testing.T) {
+	if _, err := newFileBackupStore(""); err == nil {
+		t.Error("set up a file store without a file")
+	}
+
+	path := filepath.Join(t.TempDir(), "backups.ndjson")
+	if err := ioutil.WriteFile(path, []byte(`{"volumeId": "vol-a"}`+"\n\n{invalid\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newFileBackupStore(path); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("expected an error about line 3, got %v", err)
+	}
+}
+
+func TestTagFallbackStore(t *testing.T) {
+	s, err := newFileBackupStore(filepath.Join(t.TempDir(), "backups.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := tagFallbackStore{s}
+
+	v := testVolume("gp3", 100, 3000, 125)
+	v.Tags = tags(InitialConfigurationTag, `{"VolumeType":"gp2","IOPS":300}`)
+
+	if vc, err := store.load(v, InitialConfigurationTag); err != nil || vc == nil || vc.VolumeType != "gp2" {
+		t.Errorf("initial configuration %+v, %v, want the one from the tag", vc, err)
+	}
+
+	if err := s.save(v, InitialConfigurationTag, &volumeConfig{VolumeType: "io1", IOPS: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if vc, err := store.load(v, InitialConfigurationTag); err != nil || vc == nil || vc.VolumeType != "io1" {
+		t.Errorf("initial configuration %+v, %v, want the one from the store", vc, err)
+	}
+}
+
+// fakeS3 keeps the objects in memory, counting the calls.
+type fakeS3 struct {
+	objects map[string][]byte
+	listErr error
+
+	lists, gets, puts int
+	mutex             sync.Mutex
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte)}
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.lists++
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+
+	var out s3.ListObjectsV2Output
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) {
+			out.Contents = append(out.Contents, s3types.Object{Key: aws.String(key)})
+		}
+	}
+	return &out, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.gets++
+
+	data, found := f.objects[aws.ToString(params.Key)]
+	if !found {
+		return nil, &s3types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.puts++
+
+	data, err := ioutil.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.ToString(params.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func newTestS3BackupStore(client s3API) *s3BackupStore {
+	return &s3BackupStore{
+		client:  client,
+		bucket:  "backups",
+		prefix:  "ebs",
+		cache:   make(map[string]backupRecords),
+		objects: make(map[string]map[string]bool),
+	}
+}
+
+func TestS3BackupStore(t *testing.T) {
+	fake := newFakeS3()
+	open := func() testBackupStore { return newTestS3BackupStore(fake) }
+	checkBackupStore(t, open, open)
+
+	if _, found := fake.objects["ebs/us-east-1/vol-0123456789abcdef0.ndjson"]; !found || len(fake.objects) != 2 {
+		t.Errorf("stored the objects %v", fake.objects)
+	}
+}
+
+func TestS3BackupStoreReads(t *testing.T) {
+	fake := newFakeS3()
+	v := testVolume("gp2", 100, 300, 0)
+	if err := newTestS3BackupStore(fake).save(v, InitialConfigurationTag, &volumeConfig{VolumeType: "gp2", IOPS: 300}); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.lists, fake.gets = 0, 0
+	s := newTestS3BackupStore(fake)
+	for _, id := range []string{"vol-a", "vol-b", "vol-c"} {
+		other := testVolume("gp2", 100, 300, 0)
+		other.VolumeId = aws.String(id)
+		if vc, err := s.load(other, InitialConfigurationTag); err != nil || vc != nil {
+			t.Errorf("loaded %+v, %v for a volume without backups", vc, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if vc, err := s.load(v, InitialConfigurationTag); err != nil || vc == nil {
+			t.Errorf("loaded %+v, %v, want the initial configuration", vc, err)
+		}
+	}
+	if fake.lists != 1 || fake.gets != 1 {
+		t.Errorf("listed the objects %d times and read %d objects, want once and one", fake.lists, fake.gets)
+	}
+
+	// without the listing, every volume is read once
+	fake.listErr = errors.New("access denied")
+	fake.lists, fake.gets = 0, 0
+	s = newTestS3BackupStore(fake)
+	for _, id := range []string{"vol-a", "vol-a", "vol-b"} {
+		other := testVolume("gp2", 100, 300, 0)
+		other.VolumeId = aws.String(id)
+		if vc, err := s.load(other, InitialConfigurationTag); err != nil || vc != nil {
+			t.Errorf("loaded %+v, %v for a volume without backups", vc, err)
+		}
+	}
+	if fake.lists != 1 || fake.gets != 2 {
+		t.Errorf("listed the objects %d times and read %d objects, want once and two", fake.lists, fake.gets)
+	}
+}
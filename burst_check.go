@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// depletedBurstBalance is the BurstBalance percentage at or under which a gp2
+// volume is considered to have run out of burst credits.
+const depletedBurstBalance = 1.0
+
+// burstReport is the evidence of the burst safety check, which models whether
+// the workload of a gp2 volume would be throttled by its target configuration.
+type burstReport struct {
+	BaselineIOPS    int32    `json:"baselineIops"`
+	MinBurstBalance *float64 `json:"minBurstBalance,omitempty"`
+	PeakIOPS        int32    `json:"peakIops"`
+	PeakThroughput  int32    `json:"peakThroughput"`
+
+	// whether the burst credits ran out, capping the peaks at the baseline
+	Depleted bool `json:"depleted"`
+	// the estimated demand, which is the peak usage unless the credits ran out
+	DemandIOPS       int32 `json:"demandIops"`
+	DemandThroughput int32 `json:"demandThroughput"`
+
+	TargetIOPS       int32 `json:"targetIops"`
+	TargetThroughput int32 `json:"targetThroughput"`
+
+	Throttled  bool   `json:"throttled"`
+	Resolution string `json:"resolution"`
+}
+
+// delivered returns the IOPS and throughput delivered by the configuration.
+func (vc *volumeConfig) delivered() (int32, int32) {
+	vi := ebsInfo[string(vc.VolumeType)]
+	iops, throughput := vi.performance(vc.Size, vc.IOPS)
+	if vi.configurableThroughput {
+		throughput = vc.Throughput
+	}
+	return iops, throughput
+}
+
+// checkBurst compares the peak usage of a gp2 volume, which may have been
+// reached by bursting, with the performance of its target configuration. When
+// the burst balance ran out, the volume was throttled to its baseline and the
+// peaks underestimate the demand, which is then assumed to be at least the
+// burst performance of the volume. If the target would throttle the workload,
+// the decision is taken again with the demand as requirements. When covering
+// it is no cheaper than the current configuration, it returns a nil decision
+// and the volume needs to be reviewed. Without enough metrics the decision is
+// kept as it is.
+func (v *EBSVolume) checkBurst(d *volumeDecision) (*volumeDecision, *burstReport) {
+
+	u, err := v.usage()
+	if err != nil {
+		log.Printf("Couldn't read the metrics of volume %s in %s, skipping the burst check: %s\n", *v.VolumeId, v.region, err.Error())
+		return d, nil
+	}
+	if u == nil {
+		debug.Printf("Not enough metrics for the burst check of volume %s in %s\n", *v.VolumeId, v.region)
+		return d, nil
+	}
+
+	gp2 := ebsInfo["gp2"]
+	baseline, throughput := gp2.performance(d.Current.Size, 0)
+	targetIOPS, targetThroughput := d.Target.delivered()
+
+	br := &burstReport{
+		BaselineIOPS:     baseline,
+		MinBurstBalance:  u.MinBurstBalance,
+		PeakIOPS:         u.PeakIOPS,
+		PeakThroughput:   u.PeakThroughput,
+		DemandIOPS:       u.PeakIOPS,
+		DemandThroughput: u.PeakThroughput,
+		TargetIOPS:       targetIOPS,
+		TargetThroughput: targetThroughput,
+	}
+
+	if u.MinBurstBalance != nil && *u.MinBurstBalance <= depletedBurstBalance {
+		br.Depleted = true
+		br.DemandIOPS = max32(br.DemandIOPS, max32(baseline, gp2.iopsBurst))
+		br.DemandThroughput = max32(br.DemandThroughput, throughput)
+		log.Printf("Volume %s in %s ran out of burst credits, assuming a demand of at least %d IOPS and %dMiB/s\n",
+			*v.VolumeId, v.region, br.DemandIOPS, br.DemandThroughput)
+	}
+
+	if br.DemandIOPS <= targetIOPS && br.DemandThroughput <= targetThroughput {
+		br.Resolution = "the target configuration covers the peak usage"
+		if br.Depleted {
+			br.Resolution = "the target configuration covers the burst performance of the volume"
+		}
+		return d, br
+	}
+	br.Throttled = true
+
+	log.Printf("Volume %s in %s would be throttled by %s, its demand is %d IOPS and %dMiB/s\n",
+		*v.VolumeId, v.region, d.Target.toString(), br.DemandIOPS, br.DemandThroughput)
+
+	pe := d.Requirements
+	pe.IOPS = max32(pe.IOPS, br.DemandIOPS)
+	pe.Throughput = max32(pe.Throughput, br.DemandThroughput)
+
+	covered := v.decideFor(pe)
+	// the configurations required by the policy or the tags are used whatever their price
+	cheaper := covered.Target.calculateMonthlyPrice() < covered.currentPrice()-priceEpsilon
+	if covered.changed() && (cheaper || pe.TargetType != "" || !pe.meetsMinimums(&covered.Current)) {
+		iops, throughput := covered.Target.delivered()
+		br.TargetIOPS, br.TargetThroughput = iops, throughput
+		br.Resolution = fmt.Sprintf("provisioned %d IOPS and %dMiB/s for covering the demand", iops, throughput)
+		log.Printf("Volume %s in %s: %s\n", *v.VolumeId, v.region, br.Resolution)
+		return covered, br
+	}
+
+	br.Resolution = "covering the demand is not cheaper than the current configuration"
+	log.Printf("Volume %s in %s needs review: %s\n", *v.VolumeId, v.region, br.Resolution)
+	return nil, br
+}
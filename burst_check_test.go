@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckBurst(t *testing.T) {
+	tests := []struct {
+		name           string
+		size           int32
+		iops           []float64
+		throughput     []float64
+		burst          []float64
+		wantReview     bool
+		wantThrottled  bool
+		wantDepleted   bool
+		wantIOPS       int32
+		wantThroughput int32
+	}{
+		{
+			name:           "peaks covered by the gp3 baseline",
+			size:           100,
+			iops:           repeat(2500, 20),
+			throughput:     repeat(100, 20),
+			burst:          []float64{100, 35},
+			wantIOPS:       3000,
+			wantThroughput: 125,
+		},
+		{
+			name:           "throughput peak above the gp3 baseline",
+			size:           500,
+			iops:           repeat(1000, 20),
+			throughput:     repeat(200, 20),
+			burst:          []float64{100, 60},
+			wantThrottled:  true,
+			wantIOPS:       3000,
+			wantThroughput: 200,
+		},
+		{
+			name:           "depleted balance sized for the burst performance",
+			size:           100,
+			iops:           repeat(300, 20),
+			throughput:     repeat(40, 20),
+			burst:          []float64{20, 0},
+			wantThrottled:  true,
+			wantDepleted:   true,
+			wantIOPS:       3000,
+			wantThroughput: 128,
+		},
+		{
+			name:           "depleted balance of a volume above the burst performance",
+			size:           2000,
+			iops:           repeat(6000, 20),
+			throughput:     repeat(100, 20),
+			burst:          []float64{0.5},
+			wantThrottled:  true,
+			wantDepleted:   true,
+			wantIOPS:       6000,
+			wantThroughput: 250,
+		},
+		{
+			name:          "covering the peaks isn't cheaper",
+			size:          100,
+			iops:          repeat(3000, 20),
+			throughput:    repeat(250, 20),
+			burst:         []float64{50},
+			wantReview:    true,
+			wantThrottled: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.GP2BurstCheck = true
+				c.MetricsLookback = 14 * 24 * time.Hour
+				c.MetricsPercentile = 99
+			})
+
+			v := testVolume("gp2", tt.size, 3*tt.size, 0)
+			v.api.cloudwatch = &fakeCloudWatch{values: map[string][]float64{
+				"iops":       tt.iops,
+				"throughput": tt.throughput,
+				"burst":      tt.burst,
+			}}
+
+			d := v.decide()
+			if d.Target.VolumeType != "gp3" {
+				t.Fatalf("converted to %s, want gp3", d.Target.VolumeType)
+			}
+
+			checked, br := v.checkBurst(d)
+			if br == nil {
+				t.Fatal("missing burst report")
+			}
+			if br.Throttled != tt.wantThrottled || br.Depleted != tt.wantDepleted {
+				t.Errorf("throttled %v and depleted %v, want %v and %v (%+v)",
+					br.Throttled, br.Depleted, tt.wantThrottled, tt.wantDepleted, br)
+			}
+
+			if tt.wantReview {
+				if checked != nil {
+					t.Errorf("converted to %s, want a review", checked.Target.toString())
+				}
+				return
+			}
+			if checked == nil {
+				t.Fatalf("needs review: %s", br.Resolution)
+			}
+			if checked.Target.IOPS != tt.wantIOPS || checked.Target.Throughput != tt.wantThroughput {
+				t.Errorf("converted to %d IOPS and %dMiB/s, want %d IOPS and %dMiB/s",
+					checked.Target.IOPS, checked.Target.Throughput, tt.wantIOPS, tt.wantThroughput)
+			}
+		})
+	}
+}
+
+func TestCheckBurstWithoutMetrics(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.GP2BurstCheck = true
+		c.MetricsLookback = 14 * 24 * time.Hour
+	})
+
+	v := testVolume("gp2", 100, 300, 0)
+	v.api.cloudwatch = &fakeCloudWatch{}
+
+	d := v.decide()
+	if checked, br := v.checkBurst(d); checked != d || br != nil {
+		t.Errorf("changed the decision without metrics: %+v", br)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// icalDuration matches the iCalendar durations such as P1D, PT4H or P1DT2H30M.
+var icalDuration = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// icalProperty is a content line of an iCalendar file, such as
+// DTSTART;TZID=Europe/Berlin:20261224T000000
+type icalProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// loadBlackoutCalendar reads the blackout periods from an iCalendar file.
+func loadBlackoutCalendar(path string) ([]blackoutPeriod, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	periods, err := parseBlackoutCalendar(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid blackout calendar %s: %w", path, err)
+	}
+	return periods, nil
+}
+
+// parseBlackoutCalendar converts the events of an iCalendar file to blackout
+// periods, sorted by their start. This is a minimal parser, which only reads
+// the DTSTART, DTEND, DURATION, SUMMARY and STATUS properties of the VEVENT
+// components, ignoring those of their nested components such as VALARM, and
+// rejects the recurring events rather than missing some of their occurrences.
+// Dates without a time zone are considered in UTC.
+func parseBlackoutCalendar(data string) ([]blackoutPeriod, error) {
+	// unfold the lines continued on the next line after a space or a tab
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\n ", "")
+	data = strings.ReplaceAll(data, "\n\t", "")
+
+	var periods []blackoutPeriod
+	var event map[string]icalProperty
+
+	// the nested components being parsed, such as VCALENDAR, VEVENT and VALARM
+	var components []string
+
+	for n, line := range strings.Split(data, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		p, err := parseICalProperty(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+
+		switch p.name {
+		case "BEGIN":
+			component := strings.ToUpper(p.value)
+			if component == "VEVENT" {
+				if event != nil {
+					return nil, fmt.Errorf("line %d: nested VEVENT", n+1)
+				}
+				event = make(map[string]icalProperty)
+			}
+			components = append(components, component)
+
+		case "END":
+			component := strings.ToUpper(p.value)
+			if len(components) == 0 || components[len(components)-1] != component {
+				return nil, fmt.Errorf("line %d: END:%s without BEGIN:%s", n+1, p.value, p.value)
+			}
+			components = components[:len(components)-1]
+
+			if component == "VEVENT" {
+				b, err := newBlackoutPeriod(event)
+				if err != nil {
+					return nil, fmt.Errorf("event ending on line %d: %w", n+1, err)
+				}
+				if b != nil {
+					periods = append(periods, *b)
+				}
+				event = nil
+			}
+
+		default:
+			// only the properties of the event itself, not of its alarms
+			if event != nil && components[len(components)-1] == "VEVENT" {
+				event[p.name] = p
+			}
+		}
+	}
+	if len(components) > 0 {
+		return nil, fmt.Errorf("missing END:%s", components[len(components)-1])
+	}
+
+	sort.Slice(periods, func(i, j int) bool {
+		return periods[i].Start.Before(periods[j].Start)
+	})
+	return periods, nil
+}
+
+func parseICalProperty(line string) (icalProperty, error) {
+	p := icalProperty{params: make(map[string]string)}
+
+	colon := strings.IndexByte(line, ':')
+	if colon < 0 {
+		return p, fmt.Errorf("invalid content line %q", line)
+	}
+	p.value = strings.TrimSpace(line[colon+1:])
+
+	parts := strings.Split(line[:colon], ";")
+	p.name = strings.ToUpper(strings.TrimSpace(parts[0]))
+	for _, param := range parts[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 {
+			p.params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return p, nil
+}
+
+// newBlackoutPeriod converts the properties of an event, returning nil for the
+// cancelled events.
+func newBlackoutPeriod(event map[string]icalProperty) (*blackoutPeriod, error) {
+	if event["STATUS"].value == "CANCELLED" {
+		return nil, nil
+	}
+	if _, found := event["RRULE"]; found {
+		return nil, fmt.Errorf("recurring events aren't supported")
+	}
+
+	dtstart, found := event["DTSTART"]
+	if !found {
+		return nil, fmt.Errorf("missing DTSTART")
+	}
+	start, allDay, err := parseICalTime(dtstart)
+	if err != nil {
+		return nil, err
+	}
+
+	b := blackoutPeriod{Summary: event["SUMMARY"].value, Start: start}
+
+	if dtend, found := event["DTEND"]; found {
+		if b.End, _, err = parseICalTime(dtend); err != nil {
+			return nil, err
+		}
+	} else if duration, found := event["DURATION"]; found {
+		d, err := parseICalDuration(duration.value)
+		if err != nil {
+			return nil, err
+		}
+		b.End = start.Add(d)
+	} else if allDay {
+		b.End = start.AddDate(0, 0, 1)
+	} else {
+		b.End = start
+	}
+
+	if b.End.Before(b.Start) {
+		return nil, fmt.Errorf("event %q ends before it starts", b.Summary)
+	}
+	return &b, nil
+}
+
+// parseICalTime parses the DATE and DATE-TIME values, returning whether the
+// value is a date.
+func parseICalTime(p icalProperty) (time.Time, bool, error) {
+	loc := time.UTC
+	if tzid := p.params["TZID"]; tzid != "" {
+		l, err := time.LoadLocation(tzid)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("%s: %w", p.name, err)
+		}
+		loc = l
+	}
+
+	var t time.Time
+	var err error
+	allDay := p.params["VALUE"] == "DATE" || len(p.value) == len("20060102")
+
+	switch {
+	case allDay:
+		t, err = time.ParseInLocation("20060102", p.value, loc)
+	case strings.HasSuffix(p.value, "Z"):
+		t, err = time.Parse("20060102T150405Z", p.value)
+	default:
+		t, err = time.ParseInLocation("20060102T150405", p.value, loc)
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid %s %q", p.name, p.value)
+	}
+	return t, allDay, nil
+}
+
+func parseICalDuration(s string) (time.Duration, error) {
+	m := icalDuration.FindStringSubmatch(s)
+	if m == nil || s == "P" || s == "PT" {
+		return 0, fmt.Errorf("invalid DURATION %q", s)
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, unit := range units {
+		if m[i+1] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid DURATION %q", s)
+		}
+		d += time.Duration(n) * unit
+	}
+	return d, nil
+}
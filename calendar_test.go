@@ -0,0 +1,238 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// calendar wraps the lines in a VCALENDAR, with the CRLF line endings of the
+// iCalendar files.
+func calendar(lines ...string) string {
+	all := append([]string{"BEGIN:VCALENDAR", "VERSION:2.0", "PRODID:-//test//EN"}, lines...)
+	all = append(all, "END:VCALENDAR")
+	return strings.Join(all, "\r\n") + "\r\n"
+}
+
+func TestParseBlackoutCalendar(t *testing.T) {
+	tests := []struct {
+		name     string
+		calendar string
+		want     []blackoutPeriod
+	}{
+		{
+			name: "UTC times",
+			calendar: calendar(
+				"BEGIN:VEVENT", "SUMMARY:Release", "DTSTART:20261120T080000Z", "DTEND:20261120T200000Z", "END:VEVENT",
+			),
+			want: []blackoutPeriod{{"Release", mustParseTime(t, "2026-11-20T08:00:00Z"), mustParseTime(t, "2026-11-20T20:00:00Z")}},
+		},
+		{
+			name: "time zone",
+			calendar: calendar(
+				"BEGIN:VEVENT", "SUMMARY:Sale",
+				"DTSTART;TZID=America/New_York:20261127T000000",
+				`DTEND;TZID="America/New_York":20261201T000000`,
+				"END:VEVENT",
+			),
+			want: []blackoutPeriod{{"Sale", mustParseTime(t, "2026-11-27T05:00:00Z"), mustParseTime(t, "2026-12-01T05:00:00Z")}},
+		},
+		{
+			name: "floating time in UTC",
+			calendar: calendar(
+				"BEGIN:VEVENT", "SUMMARY:Audit", "DTSTART:20261105T090000", "DTEND:20261105T170000", "END:VEVENT",
+			),
+			want: []blackoutPeriod{{"Audit", mustParseTime(t, "2026-11-05T09:00:00Z"), mustParseTime(t, "2026-11-05T17:00:00Z")}},
+		},
+		{
+			name: "all-day events",
+			calendar: calendar(
+				"BEGIN:VEVENT", "SUMMARY:Holiday", "DTSTART;VALUE=DATE:20261225", "END:VEVENT",
+				"BEGIN:VEVENT", "SUMMARY:Year end", "DTSTART;VALUE=DATE:20261228", "DTEND;VALUE=DATE:20270102", "END:VEVENT",
+			),
+			want: []blackoutPeriod{
+				{"Holiday", mustParseTime(t, "2026-12-25T00:00:00Z"), mustParseTime(t, "2026-12-26T00:00:00Z")},
+				{"Year end", mustParseTime(t, "2026-12-28T00:00:00Z"), mustParseTime(t, "2027-01-02T00:00:00Z")},
+			},
+		},
+		{
+			name: "duration",
+			calendar: calendar(
+				"BEGIN:VEVENT", "SUMMARY:Migration", "DTSTART:20261110T220000Z", "DURATION:P1DT2H30M", "END:VEVENT",
+			),
+			want: []blackoutPeriod{{"Migration", mustParseTime(t, "2026-11-10T22:00:00Z"), mustParseTime(t, "2026-11-12T00:30:00Z")}},
+		},
+		{
+			name: "alarm properties ignored",
+			calendar: calendar(
+				"BEGIN:VEVENT", "SUMMARY:Launch", "DTSTART:20261110T080000Z", "DURATION:PT4H",
+				"BEGIN:VALARM", "ACTION:DISPLAY", "SUMMARY:Reminder", "TRIGGER:-PT15M", "DURATION:PT5M", "REPEAT:2", "END:VALARM",
+				"STATUS:CONFIRMED",
+				"END:VEVENT",
+			),
+			want: []blackoutPeriod{{"Launch", mustParseTime(t, "2026-11-10T08:00:00Z"), mustParseTime(t, "2026-11-10T12:00:00Z")}},
+		},
+		{
+			name: "time zone definitions ignored",
+			calendar: calendar(
+				"BEGIN:VTIMEZONE", "TZID:Europe/Berlin",
+				"BEGIN:STANDARD", "DTSTART:19701025T030000", "TZOFFSETFROM:+0200", "TZOFFSETTO:+0100", "END:STANDARD",
+				"END:VTIMEZONE",
+				"BEGIN:VEVENT", "SUMMARY:Freeze", "DTSTART;TZID=Europe/Berlin:20261201T000000", "DURATION:P1W", "END:VEVENT",
+			),
+			want: []blackoutPeriod{{"Freeze", mustParseTime(t, "2026-11-30T23:00:00Z"), mustParseTime(t, "2026-12-07T23:00:00Z")}},
+		},
+		{
+			name: "cancelled events skipped and sorted by start",
+			calendar: calendar(
+				"BEGIN:VEVENT", "SUMMARY:Second", "DTSTART:20261202T000000Z", "DTEND:20261203T000000Z", "END:VEVENT",
+				"BEGIN:VEVENT", "SUMMARY:Cancelled", "STATUS:CANCELLED", "DTSTART:20261101T000000Z", "END:VEVENT",
+				"BEGIN:VEVENT", "SUMMARY:First", "DTSTART:20261201T000000Z", "DTEND:20261201T010000Z", "END:VEVENT",
+			),
+			want: []blackoutPeriod{
+				{"First", mustParseTime(t, "2026-12-01T00:00:00Z"), mustParseTime(t, "2026-12-01T01:00:00Z")},
+				{"Second", mustParseTime(t, "2026-12-02T00:00:00Z"), mustParseTime(t, "2026-12-03T00:00:00Z")},
+			},
+		},
+		{
+			name: "folded lines",
+			calendar: calendar(
+				"BEGIN:VEVENT", "SUMMARY:Quarter end", " freeze", "DTSTART:2026123", "\t1T000000Z", "DURATION:PT1H", "END:VEVENT",
+			),
+			want: []blackoutPeriod{{"Quarter endfreeze", mustParseTime(t, "2026-12-31T00:00:00Z"), mustParseTime(t, "2026-12-31T01:00:00Z")}},
+		},
+		{
+			name:     "no events",
+			calendar: calendar(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBlackoutCalendar(tt.calendar)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d periods %+v, want %d", len(got), got, len(tt.want))
+			}
+			for i := range got {
+				g, w := got[i], tt.want[i]
+				if g.Summary != w.Summary || !g.Start.Equal(w.Start) || !g.End.Equal(w.End) {
+					t.Errorf("period %d is %q from %s to %s, want %q from %s to %s", i,
+						g.Summary, g.Start.UTC().Format(time.RFC3339), g.End.UTC().Format(time.RFC3339),
+						w.Summary, w.Start.UTC().Format(time.RFC3339), w.End.UTC().Format(time.RFC3339))
+				}
+			}
+		})
+	}
+}
+
+func TestParseBlackoutCalendarErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		calendar string
+		want     string
+	}{
+		{
+			name:     "recurring event",
+			calendar: calendar("BEGIN:VEVENT", "DTSTART:20261201T000000Z", "RRULE:FREQ=WEEKLY", "END:VEVENT"),
+			want:     "recurring events aren't supported",
+		},
+		{
+			name:     "missing start",
+			calendar: calendar("BEGIN:VEVENT", "SUMMARY:Nothing", "END:VEVENT"),
+			want:     "missing DTSTART",
+		},
+		{
+			name:     "ending before the start",
+			calendar: calendar("BEGIN:VEVENT", "SUMMARY:Backwards", "DTSTART:20261202T000000Z", "DTEND:20261201T000000Z", "END:VEVENT"),
+			want:     `event "Backwards" ends before it starts`,
+		},
+		{
+			name:     "unknown time zone",
+			calendar: calendar("BEGIN:VEVENT", "DTSTART;TZID=Mars/Olympus_Mons:20261201T000000", "END:VEVENT"),
+			want:     "DTSTART",
+		},
+		{
+			name:     "invalid date",
+			calendar: calendar("BEGIN:VEVENT", "DTSTART:2026-12-01", "END:VEVENT"),
+			want:     `invalid DTSTART "2026-12-01"`,
+		},
+		{
+			name:     "invalid duration",
+			calendar: calendar("BEGIN:VEVENT", "DTSTART:20261201T000000Z", "DURATION:1H", "END:VEVENT"),
+			want:     `invalid DURATION "1H"`,
+		},
+		{
+			name:     "invalid content line",
+			calendar: calendar("BEGIN:VEVENT", "DTSTART 20261201T000000Z", "END:VEVENT"),
+			want:     "line 5: invalid content line",
+		},
+		{
+			name:     "end without begin",
+			calendar: calendar("DTSTART:20261201T000000Z", "END:VEVENT"),
+			want:     "line 5: END:VEVENT without BEGIN:VEVENT",
+		},
+		{
+			name:     "unterminated alarm",
+			calendar: calendar("BEGIN:VEVENT", "DTSTART:20261201T000000Z", "BEGIN:VALARM", "END:VEVENT"),
+			want:     "line 7: END:VEVENT without BEGIN:VEVENT",
+		},
+		{
+			name:     "nested events",
+			calendar: calendar("BEGIN:VEVENT", "BEGIN:VEVENT", "END:VEVENT", "END:VEVENT"),
+			want:     "line 5: nested VEVENT",
+		},
+		{
+			name:     "missing end",
+			calendar: "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nDTSTART:20261201T000000Z\r\n",
+			want:     "missing END:VEVENT",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseBlackoutCalendar(tt.calendar)
+			if err == nil {
+				t.Fatal("parsed without errors")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q doesn't mention %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseICalDuration(t *testing.T) {
+	tests := []struct {
+		text string
+		want time.Duration
+	}{
+		{"PT15M", 15 * time.Minute},
+		{"PT4H", 4 * time.Hour},
+		{"PT90S", 90 * time.Second},
+		{"P1D", 24 * time.Hour},
+		{"P2W", 14 * 24 * time.Hour},
+		{"P1DT2H30M", 26*time.Hour + 30*time.Minute},
+		{"P0D", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := parseICalDuration(tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseICalDuration(%q) = %s, want %s", tt.text, got, tt.want)
+			}
+		})
+	}
+
+	for _, text := range []string{"", "P", "PT", "1H", "PT1.5H", "-PT15M", "P1H"} {
+		if _, err := parseICalDuration(text); err == nil {
+			t.Errorf("parsed the invalid duration %q", text)
+		}
+	}
+}
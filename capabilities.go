@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// volumeCapability describes the availability and the limits of a volume type
+// in a region.
+type volumeCapability struct {
+	Available     bool  `json:"available"`
+	MaxIOPS       int32 `json:"maxIOPS,omitempty"`
+	MaxThroughput int32 `json:"maxThroughput,omitempty"`
+	MaxSizeTB     int32 `json:"maxSizeTB,omitempty"`
+}
+
+// capabilityOverride is the format of the entries of the capabilities file,
+// where only the given fields override the derived capabilities.
+type capabilityOverride struct {
+	Available     *bool  `json:"available,omitempty"`
+	MaxIOPS       *int32 `json:"maxIOPS,omitempty"`
+	MaxThroughput *int32 `json:"maxThroughput,omitempty"`
+	MaxSizeTB     *int32 `json:"maxSizeTB,omitempty"`
+}
+
+// learnedCapabilities stores the limits found in the attributes of the Pricing
+// API storage products, keyed by region and volume type.
+var learnedCapabilities = make(map[string]map[string]volumeCapability)
+
+// capabilityOverrides stores the content of the capabilities file, keyed by
+// region and volume type, where the "*" region applies to all regions.
+var capabilityOverrides map[string]map[string]capabilityOverride
+
+// learnCapabilities records the limits advertised by a storage product.
+func learnCapabilities(vi volumeInfo, region string, p *Pricing) {
+	attrs := p.Product.Attributes
+
+	vc := volumeCapability{
+		Available:     true,
+		MaxIOPS:       parseLeadingInt(attrs.MaxIopsvolume),
+		MaxThroughput: parseLeadingInt(attrs.MaxThroughputvolume),
+		MaxSizeTB:     parseLeadingInt(attrs.MaxVolumeSize),
+	}
+	debug.Printf("Learned %s capabilities in %s: %+v\n", vi.name, region, vc)
+
+	if learnedCapabilities[region] == nil {
+		learnedCapabilities[region] = make(map[string]volumeCapability)
+	}
+	learnedCapabilities[region][vi.name] = vc
+}
+
+// parseLeadingInt parses the number at the beginning of attribute values such
+// as "1000 MiB/s" or "16 TiB", returning 0 if there is none.
+func parseLeadingInt(s string) int32 {
+	s = strings.TrimSpace(s)
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	n, err := strconv.ParseInt(s[:end], 10, 32)
+	if err != nil {
+		return 0
+	}
+	return int32(n)
+}
+
+// loadCapabilityOverrides reads the capabilities file, which contains a JSON
+// object keyed by region (or "*" for all regions) and volume type, such as
+// {"*": {"io2": {"maxIOPS": 64000}}, "ap-south-2": {"io2": {"available": false}}}
+func loadCapabilityOverrides(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var overrides map[string]map[string]capabilityOverride
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return fmt.Errorf("couldn't parse the capabilities file %s: %w", path, err)
+	}
+
+	for region, types := range overrides {
+		for vt := range types {
+			if _, found := ebsInfo[vt]; !found {
+				return fmt.Errorf("unknown volume type %q for region %s in the capabilities file %s", vt, region, path)
+			}
+		}
+	}
+
+	log.Println("Loaded capability overrides from", path)
+	capabilityOverrides = overrides
+	return nil
+}
+
+// hasPricing returns true if the region has pricing data for any volume type.
+func hasPricing(region string) bool {
+	for _, vi := range ebsInfo {
+		if vi.Pricing[region].pricePerGB > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// capabilities returns the capabilities of a volume type in a region. A volume
+// type is available in the regions where it has pricing data, and the limits
+// default to the ones from ebsInfo, lowered to those advertised in the Pricing
+// API products. The overrides from the capabilities file are applied last. For
+// the regions without any pricing data the volume types are assumed available.
+func capabilities(region, volumeType string) volumeCapability {
+	vi := ebsInfo[volumeType]
+
+	c := volumeCapability{
+		Available:     vi.Pricing[region].pricePerGB > 0 || !hasPricing(region),
+		MaxIOPS:       vi.maxIOPS,
+		MaxThroughput: vi.maxThroughput,
+		MaxSizeTB:     vi.maxSizeTB,
+	}
+
+	if lc, found := learnedCapabilities[region][volumeType]; found {
+		if lc.MaxIOPS > 0 {
+			c.MaxIOPS = min32(c.MaxIOPS, lc.MaxIOPS)
+		}
+		if lc.MaxThroughput > 0 {
+			c.MaxThroughput = min32(c.MaxThroughput, lc.MaxThroughput)
+		}
+		if lc.MaxSizeTB > 0 {
+			c.MaxSizeTB = min32(c.MaxSizeTB, lc.MaxSizeTB)
+		}
+	}
+
+	for _, r := range []string{"*", region} {
+		if o, found := capabilityOverrides[r][volumeType]; found {
+			o.applyTo(&c)
+		}
+	}
+	return c
+}
+
+func (o *capabilityOverride) applyTo(c *volumeCapability) {
+	if o.Available != nil {
+		c.Available = *o.Available
+	}
+	if o.MaxIOPS != nil {
+		c.MaxIOPS = *o.MaxIOPS
+	}
+	if o.MaxThroughput != nil {
+		c.MaxThroughput = *o.MaxThroughput
+	}
+	if o.MaxSizeTB != nil {
+		c.MaxSizeTB = *o.MaxSizeTB
+	}
+}
+
+// supports checks if the volume type is available in the region.
+func supports(region, volumeType string) bool {
+	return capabilities(region, volumeType).Available
+}
+
+// regionalVolumeInfo returns the information about the volume type, with its
+// limits adjusted to the capabilities of the given region.
+func regionalVolumeInfo(volumeType, region string) (volumeInfo, bool) {
+	vi, found := ebsInfo[volumeType]
+	if !found {
+		return vi, false
+	}
+
+	c := capabilities(region, volumeType)
+	vi.maxIOPS, vi.maxThroughput, vi.maxSizeTB = c.MaxIOPS, c.MaxThroughput, c.MaxSizeTB
+	return vi, true
+}
+
+// logCapabilities logs the capability catalog of a region.
+func logCapabilities(region string) {
+	var lines []string
+	for name := range ebsInfo {
+		c := capabilities(region, name)
+		lines = append(lines, fmt.Sprintf("%s: %+v", name, c))
+	}
+	debug.Printf("Volume capabilities in %s: %s\n", region, strings.Join(lines, ", "))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// outpostVolumeTypes are the volume types offered by EBS on Outposts, where the
+// volume type of the volumes can't be changed either.
+var outpostVolumeTypes = map[string]bool{"gp2": true}
+
+// compatibilityRule checks whether the volume can be converted to the target
+// volume type, returning the reason why it can't, or an empty string. The
+// target may be the current volume type, when only its settings would change.
+type compatibilityRule struct {
+	name  string
+	check func(v *EBSVolume, target volumeInfo) string
+}
+
+// compatibilityRules are evaluated before planning, so that the volumes are
+// never converted to volume types the ModifyVolume API would refuse.
+var compatibilityRules = []compatibilityRule{
+	{
+		name: "multi-attach",
+		check: func(v *EBSVolume, target volumeInfo) string {
+			if !aws.ToBool(v.MultiAttachEnabled) {
+				return ""
+			}
+			if v.VolumeType == types.VolumeTypeIo1 {
+				return "the settings of multi-attach io1 volumes can't be modified"
+			}
+			if string(v.VolumeType) != target.name {
+				return "the volume type of multi-attach volumes can't be changed"
+			}
+			return ""
+		},
+	},
+	{
+		name: "outposts",
+		check: func(v *EBSVolume, target volumeInfo) string {
+			if aws.ToString(v.OutpostArn) == "" {
+				return ""
+			}
+			if !outpostVolumeTypes[target.name] {
+				return "not available on Outposts"
+			}
+			if string(v.VolumeType) != target.name {
+				return "the volume type of volumes on Outposts can't be changed"
+			}
+			return ""
+		},
+	},
+	{
+		name: "boot volume",
+		check: func(v *EBSVolume, target volumeInfo) string {
+			if v.isBootVolume() && !target.bootable {
+				return "not bootable, and the volume is attached as a boot volume"
+			}
+			return ""
+		},
+	},
+	{
+		name: "minimum size",
+		check: func(v *EBSVolume, target volumeInfo) string {
+			if size := aws.ToInt32(v.Size); size < target.minSizeGB {
+				return fmt.Sprintf("requires at least %dGB, the volume has %dGB", target.minSizeGB, size)
+			}
+			return ""
+		},
+	},
+}
+
+// incompatibility returns why the volume can't be converted to the volume type
+// according to the compatibility rules, or an empty string if it can.
+func (v *EBSVolume) incompatibility(volumeType string) string {
+	target := ebsInfo[volumeType]
+	for _, r := range compatibilityRules {
+		if reason := r.check(v, target); reason != "" {
+			return r.name + ": " + reason
+		}
+	}
+	return ""
+}
+
+// ineligibility returns why the volume can't be modified at all, which is when
+// it can't be converted to any other volume type, nor have the settings of its
+// current volume type changed. It returns an empty string for eligible volumes.
+func (v *EBSVolume) ineligibility() string {
+	current := string(v.VolumeType)
+	vi := ebsInfo[current]
+
+	if reason := v.incompatibility(current); reason != "" {
+		return reason
+	}
+	if vi.configurableIOPS {
+		return ""
+	}
+
+	// group the volume types by the reason they were rejected for
+	rejected := make(map[string][]string)
+	for name := range ebsInfo {
+		if name == current {
+			continue
+		}
+		reason := v.incompatibility(name)
+		if reason == "" {
+			return ""
+		}
+		rejected[reason] = append(rejected[reason], name)
+	}
+
+	var reasons []string
+	for reason, names := range rejected {
+		sort.Strings(names)
+		reasons = append(reasons, fmt.Sprintf("%s (%s)", reason, strings.Join(names, ", ")))
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, "; ")
+}
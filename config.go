@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/namsral/flag"
@@ -17,6 +19,37 @@ const (
 	InitialConfigurationTag = "ebs_optimizer_initial_configuration"
 	// PreviousConfigurationTag is the name of the tag applied to the EBS volume that holds a backup of the previous configuration of the volume, in JSON format.
 	PreviousConfigurationTag = "ebs_optimizer_previous_configuration"
+	// HistoryTagPrefix is the prefix of the rotating numbered tags holding the configuration history of the EBS volume.
+	HistoryTagPrefix = "ebs_optimizer_history_"
+
+	// TargetTypeTag is the name of the tag with which the owners of the EBS volume require a volume type.
+	TargetTypeTag = "ebs_optimizer_target_type"
+	// MinIOPSTag is the name of the tag with which the owners of the EBS volume require a minimum IOPS.
+	MinIOPSTag = "ebs_optimizer_min_iops"
+	// MinThroughputTag is the name of the tag with which the owners of the EBS volume require a minimum throughput, in MiB/s.
+	MinThroughputTag = "ebs_optimizer_min_throughput"
+	// PinTag is the name of the tag which, when set to true, excludes the EBS volume from any modification.
+	PinTag = "ebs_optimizer_pin"
+	// MaintenanceWindowTag is the name of the tag replacing the global maintenance windows of the EBS volume.
+	MaintenanceWindowTag = "ebs_optimizer_maintenance_window"
+
+	// ModeOptimize is the default mode, in which volumes are converted to the optimal configuration.
+	ModeOptimize = "optimize"
+	// ModeRollback restores the volumes to a configuration previously backed up to tags.
+	ModeRollback = "rollback"
+	// ModePlan writes the planned volume conversions to the plan file, without applying them.
+	ModePlan = "plan"
+	// ModeApply executes the conversions from the plan file.
+	ModeApply = "apply"
+	// ModeHistory prints the configuration history of the volumes.
+	ModeHistory = "history"
+	// ModeValidate checks the policy file, and shows which of its rules matches each volume of the sample inventory.
+	ModeValidate = "validate"
+
+	// RollbackToInitial restores the configuration stored in the InitialConfigurationTag.
+	RollbackToInitial = "initial"
+	// RollbackToPrevious restores the configuration stored in the PreviousConfigurationTag.
+	RollbackToPrevious = "previous"
 )
 
 // Config stores the global configuration
@@ -49,8 +82,8 @@ type Config struct {
 	// The ebs-optimizer version
 	Version string
 
-	// Final Recap String Array to show actions taken by ScheduleRun on ASGs
-	FinalRecap map[string][]string
+	// File where the JSON run report is written, "-" for stdout
+	ReportFile string
 
 	// Controls whether GP3 volumes replacing GP2 should be configured with provisioned IOPS to match GP2 performance
 	GP3MatchGP2IOPS bool
@@ -58,8 +91,110 @@ type Config struct {
 	// Controls whether GP3 volumes replacing GP2 should be configured with provisioned throughput to match GP2 performance
 	GP3MatchGP2BurstThroughput bool
 
+	// MetricsSizing controls whether the performance of the GP3 volumes replacing
+	// GP2 is based on the CloudWatch metrics of the volumes: the given percentile
+	// of their usage over the lookback, increased by the headroom percentage.
+	// The same metrics are used for analyzing the utilization of the volumes
+	// with provisioned performance.
+	MetricsSizing     bool
+	MetricsLookback   time.Duration
+	MetricsPercentile float64
+	MetricsHeadroom   float64
+
+	// GP2BurstCheck controls whether the conversions of GP2 volumes are checked
+	// against their peak usage according to the metrics, for making sure the
+	// workloads relying on burst performance won't be throttled.
+	GP2BurstCheck bool
+
+	// ClampToInstanceLimits controls whether the IOPS and throughput required
+	// from the volumes are capped by the EBS limits of their instances.
+	ClampToInstanceLimits bool
+
+	// DownsizeOverprovisioned controls whether the provisioned IOPS and
+	// throughput of the GP3, IO1 and IO2 volumes are reduced toward their usage
+	// according to the metrics, instead of only being reported.
+	DownsizeOverprovisioned bool
+
 	// DryRun controls whether to run in dry-run mode (without applying any changes).
 	DryRun bool
+
+	// Mode controls the action performed on the volumes.
+	// Available options: 'optimize', 'rollback', 'plan', 'apply', 'history' and 'validate', default: 'optimize'
+	Mode string
+
+	// ID of the current execution, recorded in the configuration history.
+	RunID string
+
+	// Number of entries kept in the configuration history of each volume,
+	// when stored in tags.
+	HistorySize int
+
+	// Where the configuration backups and history are stored.
+	// Available options: 'tags', 'file' and 's3', default: 'tags'
+	BackupStore string
+
+	// The NDJSON file used by the file backup store.
+	BackupFile string
+
+	// The bucket, key prefix and optional custom endpoint of the S3-compatible
+	// API used by the s3 backup store.
+	BackupS3Bucket   string
+	BackupS3Prefix   string
+	BackupS3Endpoint string
+
+	// Duration for which the modifications of the volumes are tracked until
+	// they take effect, 0 disables tracking.
+	ModificationTimeout time.Duration
+
+	// RollbackOnFailure controls whether the volumes whose modification failed
+	// are restored to the configuration backed up in the PreviousConfigurationTag.
+	RollbackOnFailure bool
+
+	// File where the plan is written in plan mode, and read from in apply mode.
+	PlanFile string
+
+	// RollbackTo controls which backed up configuration is restored in rollback mode.
+	// Available options: 'initial' and 'previous', default: 'previous'
+	RollbackTo string
+
+	// The volume IDs that should be processed, given as a single CSV-string. By
+	// default all volumes are processed.
+	Volumes string
+
+	// The volume types and states used for filtering the volumes on the
+	// server side, each given as a single CSV-string. By default all volume
+	// types and states are processed.
+	VolumeTypes  string
+	VolumeStates string
+
+	// File used for caching the pricing data, and the duration for which the
+	// cached data is reused before fetching it again from the Pricing API.
+	PricingCacheFile string
+	PricingCacheTTL  time.Duration
+
+	// Maximum age of the pricing snapshot embedded in the binary, above which
+	// it's no longer used as a fallback. Zero disables the check.
+	PricingSnapshotMaxAge time.Duration
+
+	// JSON file overriding the availability and limits of the volume types
+	// per region, which are otherwise derived from the Pricing API data.
+	CapabilitiesFile string
+
+	// Recurring time ranges in which the volumes can be modified, separated by
+	// semicolons, such as 'Sat-Sun 02:00-06:00 Europe/Berlin'. By default the
+	// volumes can be modified at any time.
+	MaintenanceWindows string
+
+	// iCalendar file whose events are blackout periods, in which no volume is
+	// modified.
+	BlackoutCalendar string
+
+	// JSON file with the ordered rules deciding how the volumes are converted.
+	PolicyFile string
+
+	// JSON file with sample volumes, in the format of the DescribeVolumes
+	// output, against which the policy is evaluated in validate mode.
+	PolicyInventory string
 }
 
 // ParseCommandlineFlags loads configuration from command line flags, environments variables, and config files.
@@ -84,13 +219,16 @@ func (c *Config) ParseCommandlineFlags() {
 			"\tBy default it runs on all regions.\n"+
 			"\tExample: ./ebs-optimizer -regions 'eu-*,us-east-1'\n")
 
-	flagSet.StringVar(&conf.TagFilteringMode, "tag_filtering_mode", "opt-out", "\n\tControls the behavior of the tag_filters option.\n"+
-		"\tValid choices: opt-in | opt-out\n\tDefault value: 'opt-in'\n\tExample: ./ebs-optimizer --tag_filtering_mode opt-in\n")
+	flagSet.StringVar(&conf.TagFilteringMode, "tag_filtering_mode", TagFilteringModeOptOut, "\n\tControls the behavior of the tag_filters option.\n"+
+		"\tIn opt-in mode only the volumes matching all the tag filters are processed, in opt-out mode\n"+
+		"\tall volumes are processed except for those matching all the tag filters.\n"+
+		"\tValid choices: opt-in | opt-out\n\tDefault value: 'opt-out'\n\tExample: ./ebs-optimizer --tag_filtering_mode opt-in\n")
 
-	flagSet.StringVar(&conf.FilterByTags, "tag_filters", "", "\n\tSet of tags to filter the volumes on.\n"+
+	flagSet.StringVar(&conf.FilterByTags, "tag_filters", "", "\n\tSet of tags to filter the volumes on, given as comma-separated key=value pairs.\n"+
+		"\tThe values support globs, and a key given without a value matches any value of that tag.\n"+
 		"\tDefault if no value is set will be the equivalent of -tag_filters 'optimize=true'\n"+
 		"\tIn case the tag_filtering_mode is set to opt-out, it defaults to 'optimize=false'\n"+
-		"\tExample: ./ebs-optimizer --tag_filters 'optimize=true'\n")
+		"\tExample: ./ebs-optimizer --tag_filters 'optimize=true,team=data-*'\n")
 
 	flagSet.BoolVar(&conf.GP3MatchGP2IOPS, "gp3_match_gp2_iops", false,
 		"\n\tControls whether to configure GP3 volumes with provisioned IOPS to match "+
@@ -104,8 +242,157 @@ func (c *Config) ParseCommandlineFlags() {
 			"See https://cloudwiry.com/ebs-gp3-vs-gp2-pricing-comparison/ for a more detailed explanation\n"+
 			"\tExample: ./ebs-optimizer --gp3_match_gp2_throughput true\n")
 
+	flagSet.BoolVar(&conf.MetricsSizing, "metrics_sizing", false,
+		"\n\tControls whether to size the IOPS and throughput of GP3 volumes replacing GP2 based on their CloudWatch metrics,\n"+
+			"\tand to analyze the utilization of the volumes with provisioned performance.\n"+
+			"\tThe volumes lacking metrics keep the default sizing.\n"+
+			"\tExample: ./ebs-optimizer --metrics_sizing true --metrics_lookback 336h --metrics_percentile 99 --metrics_headroom 20\n")
+
+	flagSet.DurationVar(&conf.MetricsLookback, "metrics_lookback", 14*24*time.Hour,
+		"\n\tPeriod of time over which the metrics are analyzed when sizing the volumes based on metrics.\n"+
+			"\tExample: ./ebs-optimizer --metrics_sizing true --metrics_lookback 720h\n")
+
+	flagSet.Float64Var(&conf.MetricsPercentile, "metrics_percentile", 99,
+		"\n\tPercentile of the per-period IOPS and throughput used when sizing the volumes based on metrics.\n"+
+			"\tExample: ./ebs-optimizer --metrics_sizing true --metrics_percentile 95\n")
+
+	flagSet.Float64Var(&conf.MetricsHeadroom, "metrics_headroom", 20,
+		"\n\tPercentage added on top of the used IOPS and throughput when sizing the volumes based on metrics.\n"+
+			"\tExample: ./ebs-optimizer --metrics_sizing true --metrics_headroom 30\n")
+
+	flagSet.BoolVar(&conf.GP2BurstCheck, "gp2_burst_check", true,
+		"\n\tControls whether to check the conversions of GP2 volumes against their peak IOPS, throughput and burst\n"+
+			"\tbalance from CloudWatch, provisioning enough performance for the peaks or marking the volume for review.\n"+
+			"\tThe volumes which ran out of burst credits are sized for at least their burst performance.\n"+
+			"\tThe volumes lacking metrics are converted without the check, which is also skipped with a warning\n"+
+			"\twithout the cloudwatch:GetMetricData permission.\n"+
+			"\tDefault value: true\n"+
+			"\tExample: ./ebs-optimizer --gp2_burst_check=false\n")
+
+	flagSet.BoolVar(&conf.ClampToInstanceLimits, "clamp_to_instance_limits", false,
+		"\n\tControls whether to cap the IOPS and throughput of the volumes by the EBS limits of the instances they're attached to.\n"+
+			"\tMulti-attached volumes are capped by the highest limits among their instances, and not capped if any of them is unknown.\n"+
+			"\tRequires the ec2:DescribeInstances and ec2:DescribeInstanceTypes permissions.\n"+
+			"\tExample: ./ebs-optimizer --clamp_to_instance_limits true\n")
+
+	flagSet.BoolVar(&conf.DownsizeOverprovisioned, "downsize_overprovisioned", false,
+		"\n\tControls whether to reduce the provisioned IOPS and throughput of GP3, IO1 and IO2 volumes toward their\n"+
+			"\tusage according to the metrics. Otherwise the over-provisioned volumes are only flagged in the report.\n"+
+			"\tRequires metrics_sizing to be enabled.\n"+
+			"\tExample: ./ebs-optimizer --metrics_sizing true --downsize_overprovisioned true\n")
+
 	flagSet.BoolVar(&conf.DryRun, "dry_run", false, "Run in dry-run mode, just show what it would do, without applying any changes.")
 
+	flagSet.StringVar(&conf.Mode, "mode", ModeOptimize, "\n\tControls the action performed on the volumes.\n"+
+		"\tValid choices: optimize | rollback | plan | apply | history | validate\n\tDefault value: 'optimize'\n"+
+		"\tExample: ./ebs-optimizer --mode rollback --rollback_to initial\n")
+
+	flagSet.IntVar(&conf.HistorySize, "history_size", 10,
+		"\n\tNumber of configuration history entries kept in the tags of each volume, at most 40,\n"+
+			"\tand limited to the tags still available on the volumes already having 50 tags.\n"+
+			"\tExample: ./ebs-optimizer --mode history --volumes vol-0123456789abcdef0\n")
+
+	flagSet.DurationVar(&conf.ModificationTimeout, "modification_timeout", 5*time.Minute,
+		"\n\tDuration for which the volume modifications are tracked until they take effect, set it to 0 to disable tracking.\n"+
+			"\tExample: ./ebs-optimizer --modification_timeout 10m\n")
+
+	flagSet.BoolVar(&conf.RollbackOnFailure, "rollback_on_failure", false,
+		"\n\tControls whether the volumes whose modification failed are restored to their previous configuration.\n"+
+			"\tExample: ./ebs-optimizer --rollback_on_failure true\n")
+
+	flagSet.StringVar(&conf.BackupStore, "backup_store", BackupStoreTags,
+		"\n\tWhere the configuration backups and history of the volumes are stored.\n"+
+			"\tThe file and s3 stores fall back to the backups previously stored in tags.\n"+
+			"\tValid choices: tags | file | s3\n\tDefault value: 'tags'\n"+
+			"\tExample: ./ebs-optimizer --backup_store s3 --backup_s3_bucket my-backups\n")
+
+	flagSet.StringVar(&conf.BackupFile, "backup_file", "ebs-optimizer-backups.ndjson",
+		"\n\tNDJSON file used by the file backup store.\n"+
+			"\tExample: ./ebs-optimizer --backup_store file --backup_file /mnt/efs/ebs-optimizer-backups.ndjson\n")
+
+	flagSet.StringVar(&conf.BackupS3Bucket, "backup_s3_bucket", "",
+		"\n\tBucket used by the s3 backup store, which needs the s3:GetObject, s3:PutObject and s3:ListBucket permissions.\n"+
+			"\tExample: ./ebs-optimizer --backup_store s3 --backup_s3_bucket my-backups\n")
+
+	flagSet.StringVar(&conf.BackupS3Prefix, "backup_s3_prefix", "ebs-optimizer",
+		"\n\tKey prefix of the objects written by the s3 backup store.\n"+
+			"\tExample: ./ebs-optimizer --backup_store s3 --backup_s3_bucket my-backups --backup_s3_prefix backups/ebs\n")
+
+	flagSet.StringVar(&conf.BackupS3Endpoint, "backup_s3_endpoint", "",
+		"\n\tCustom endpoint of an S3-compatible API used by the s3 backup store, accessed with path-style URLs.\n"+
+			"\tExample: ./ebs-optimizer --backup_store s3 --backup_s3_bucket my-backups --backup_s3_endpoint http://localhost:9000\n")
+
+	flagSet.StringVar(&conf.PlanFile, "plan_file", "ebs-optimizer-plan.json",
+		"\n\tFile where the planned conversions are written in plan mode, and read from in apply mode.\n"+
+			"\tExample: ./ebs-optimizer --mode plan --plan_file plan.json && ./ebs-optimizer --mode apply --plan_file plan.json\n")
+
+	flagSet.StringVar(&conf.RollbackTo, "rollback_to", RollbackToPrevious, "\n\tControls which configuration backup is restored in rollback mode.\n"+
+		"\tValid choices: initial | previous\n\tDefault value: 'previous'\n"+
+		"\tExample: ./ebs-optimizer --mode rollback --rollback_to initial\n")
+
+	flagSet.StringVar(&conf.Volumes, "volumes", "",
+		"\n\tVolume IDs that should be processed (separated by comma or whitespace).\n"+
+			"\tBy default it processes all volumes.\n"+
+			"\tExample: ./ebs-optimizer --volumes 'vol-0123456789abcdef0,vol-0fedcba9876543210'\n")
+
+	flagSet.StringVar(&conf.VolumeTypes, "volume_types", "",
+		"\n\tVolume types that should be processed (separated by comma or whitespace).\n"+
+			"\tBy default it processes all volume types.\n"+
+			"\tExample: ./ebs-optimizer --volume_types 'gp2,io1'\n")
+
+	flagSet.StringVar(&conf.VolumeStates, "volume_states", "",
+		"\n\tVolume states that should be processed (separated by comma or whitespace).\n"+
+			"\tBy default it processes volumes in any state.\n"+
+			"\tExample: ./ebs-optimizer --volume_states 'in-use,available'\n")
+
+	flagSet.StringVar(&conf.PricingCacheFile, "pricing_cache_file", filepath.Join(os.TempDir(), "ebs-optimizer-pricing.json"),
+		"\n\tFile used for caching the pricing data between executions, set it to an empty string to disable the cache.\n"+
+			"\tExample: ./ebs-optimizer --pricing_cache_file /var/cache/ebs-optimizer-pricing.json\n")
+
+	flagSet.DurationVar(&conf.PricingCacheTTL, "pricing_cache_ttl", 24*time.Hour,
+		"\n\tDuration for which the cached pricing data is reused before fetching it again.\n"+
+			"\tExample: ./ebs-optimizer --pricing_cache_ttl 12h\n")
+
+	flagSet.DurationVar(&conf.PricingSnapshotMaxAge, "pricing_snapshot_max_age", 365*24*time.Hour,
+		"\n\tMaximum age of the pricing snapshot embedded in the binary, used when both the Pricing API and the cache are unavailable.\n"+
+			"\tAn older snapshot is not used and the execution fails instead. Set it to 0 to always accept the snapshot.\n"+
+			"\tDefault value: '8760h' (one year)\n"+
+			"\tExample: ./ebs-optimizer --pricing_snapshot_max_age 2160h\n")
+
+	flagSet.StringVar(&conf.CapabilitiesFile, "capabilities_file", "",
+		"\n\tJSON file overriding the availability and limits of the volume types per region.\n"+
+			"\tExample: ./ebs-optimizer --capabilities_file capabilities.json\n"+
+			"\tWith the following file content: {\"*\": {\"io2\": {\"maxIOPS\": 64000}}, \"ap-south-2\": {\"io2\": {\"available\": false}}}\n")
+
+	flagSet.StringVar(&conf.MaintenanceWindows, "maintenance_windows", "",
+		"\n\tRecurring time ranges in which the volumes can be modified, given as '<days> <HH:MM>-<HH:MM> [<time zone>]'\n"+
+			"\tand separated by semicolons. The days are '*', a weekday, a range or a comma-separated list of them.\n"+
+			"\tThe volumes tagged with "+MaintenanceWindowTag+" use the windows from the tag value instead.\n"+
+			"\tThe volumes planned outside their windows are deferred. By default the volumes can be modified at any time.\n"+
+			"\tExample: ./ebs-optimizer --maintenance_windows 'Sat-Sun 02:00-06:00 Europe/Berlin; Mon-Fri 22:00-02:00 UTC'\n")
+
+	flagSet.StringVar(&conf.BlackoutCalendar, "blackout_calendar", "",
+		"\n\tiCalendar file whose events are blackout periods, such as change freezes, in which no volume is modified.\n"+
+			"\tRecurring events are not supported.\n"+
+			"\tExample: ./ebs-optimizer --blackout_calendar change-freezes.ics\n")
+
+	flagSet.StringVar(&conf.PolicyFile, "policy_file", "",
+		"\n\tJSON or YAML file with the ordered rules deciding how the volumes are converted, the first matching rule applying to each volume.\n"+
+			"\tExample: ./ebs-optimizer --policy_file policy.json\n"+
+			"\tWith the following file content: {\"version\": 1, \"rules\": [{\"name\": \"databases\", \"match\": {\"tags\": [\"role=db*\"], \"volumeTypes\": [\"gp2\"]},\n"+
+			"\t\"action\": {\"targetType\": \"gp3\", \"iops\": \"max(3000, size * 3)\", \"throughput\": \"max(125, iops / 4)\"}}]}\n")
+
+	flagSet.StringVar(&conf.PolicyInventory, "policy_inventory", "",
+		"\n\tJSON file with sample volumes, in the format of the 'aws ec2 describe-volumes' output, optionally with the instances\n"+
+			"\tthey're attached to in an 'Instances' list, against which the policy file is evaluated in validate mode.\n"+
+			"\tExample: ./ebs-optimizer --mode validate --policy_file policy.json --policy_inventory volumes.json\n")
+
+	flagSet.StringVar(&conf.ReportFile, "report_file", "",
+		"\n\tFile where the JSON report of the execution is written, use '-' for writing it to stdout,\n"+
+			"\tin which case the logs are written to stderr.\n"+
+			"\tBy default the report is only returned by the Lambda function.\n"+
+			"\tExample: ./ebs-optimizer --report_file report.json\n")
+
 	printVersion := flagSet.Bool("version", false, "Print version number and exit.\n")
 
 	if err := flagSet.Parse(os.Args[1:]); err != nil {
@@ -116,6 +403,16 @@ func (c *Config) ParseCommandlineFlags() {
 		fmt.Println("ebs-optimizer build:", conf.Version)
 		os.Exit(0)
 	}
+}
+
+// volumeIDs returns the list of volume IDs given in the Volumes option.
+func (c *Config) volumeIDs() []string {
+	return splitList(c.Volumes)
+}
 
-	c.FinalRecap = make(map[string][]string)
+// splitList splits a list of values separated by comma or whitespace.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
 }
@@ -6,13 +6,17 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 )
 
 type ec2Conn struct {
-	config *aws.Config
-	ec2    *ec2.Client
-	region string
+	config     *aws.Config
+	ec2        *ec2.Client
+	cloudwatch cloudWatchAPI
+	region     string
+
+	instanceCache *instanceCache
 }
 
 func (c *ec2Conn) connect(region, mainRegion string) {
@@ -34,6 +38,8 @@ func (c *ec2Conn) connect(region, mainRegion string) {
 	go func() { ec2Conn <- ec2.NewFromConfig(*c.config) }()
 
 	c.ec2, c.region = <-ec2Conn, region
+	c.cloudwatch = cloudwatch.NewFromConfig(*c.config)
+	c.instanceCache = newInstanceCache()
 
 	debug.Println("Created service connections in", region)
 }
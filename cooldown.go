@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// modificationCooldown is the minimum time between two modifications of the
+// same volume, enforced by EBS.
+const modificationCooldown = 6 * time.Hour
+
+// cooldownEnd returns the time until which the volume can't be modified because
+// of a recent modification, or false if it can be modified right away.
+func (v *EBSVolume) cooldownEnd() (time.Time, bool) {
+
+	resp, err := v.api.ec2.DescribeVolumesModifications(context.TODO(), &ec2.DescribeVolumesModificationsInput{
+		Filters: []types.Filter{{
+			Name:   aws.String("volume-id"),
+			Values: []string{*v.VolumeId},
+		}},
+	})
+	if err != nil {
+		// not blocking the modification, which fails anyway if still in cooldown
+		log.Printf("Couldn't check the last modification of volume %s in %s: %s\n", *v.VolumeId, v.region, err.Error())
+		return time.Time{}, false
+	}
+
+	var last time.Time
+	for _, m := range resp.VolumesModifications {
+		if m.StartTime != nil && m.StartTime.After(last) {
+			last = *m.StartTime
+		}
+	}
+	if last.IsZero() {
+		return time.Time{}, false
+	}
+
+	end := last.Add(modificationCooldown)
+	if time.Now().After(end) {
+		return time.Time{}, false
+	}
+	debug.Printf("Volume %s in %s was last modified at %s, in cooldown until %s\n",
+		*v.VolumeId, v.region, last.Format(time.RFC3339), end.Format(time.RFC3339))
+	return end, true
+}
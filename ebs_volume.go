@@ -2,63 +2,192 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 )
 
+// The tags written for backing up the volume configuration are read back up to
+// tagVerificationAttempts times, waiting tagVerificationDelay in between.
+const (
+	tagVerificationAttempts = 3
+	tagVerificationDelay    = 2 * time.Second
+)
+
 // EBSVolume extends ec2.Volume with a few useful things.
 type EBSVolume struct {
 	types.Volume
 	api    ec2Conn
 	region string
+
+	// the usage read from the metrics, fetched at most once
+	usageRead bool
+	usageData *volumeUsage
+	usageErr  error
 }
 
-func (v *EBSVolume) process() error {
+// plan decides the target configuration of the volume without modifying it,
+// returning a report with the planned action, and the decision. The volumes
+// that the compatibility rules don't allow to modify are reported without a
+// decision. For the volumes that can't be modified right away, because of the
+// modification cooldown, of their maintenance windows or of the blackout
+// periods, the report holds the time when they become eligible.
+func (v *EBSVolume) plan() (*volumeReport, *volumeDecision) {
 
 	log.Printf("Processing volume %s in %s\n", *v.VolumeId, v.region)
-	vc := v.getCurrentConfiguration()
-	nvc := v.newVolumeConfiguration()
+	vr := newVolumeReport(v)
 
-	if vc.VolumeType == nvc.VolumeType {
+	if !v.checkOverrides(vr) || !v.checkPolicy(vr) {
+		return vr, nil
+	}
+
+	if reason := v.ineligibility(); reason != "" {
+		log.Printf("Volume %s in %s is not eligible for modification: %s\n", *v.VolumeId, v.region, reason)
+		vr.ineligible(reason)
+		return vr, nil
+	}
+
+	d := v.decide()
+	d.log()
+	vr.Candidates = d.Candidates
+	vr.Usage = d.Requirements.Usage
+	vr.Utilization = d.Requirements.Utilization
+	vr.InstanceClamp = d.Requirements.InstanceClamp
+	vr.Policy = d.Requirements.Policy
+
+	if vr.Policy != nil && vr.Policy.Error != "" {
+		log.Printf("Policy rule %q failed for volume %s in %s: %s\n", vr.Policy.Rule, *v.VolumeId, v.region, vr.Policy.Error)
+		vr.needsReview(fmt.Sprintf("policy rule %q failed: %s", vr.Policy.Rule, vr.Policy.Error))
+		return vr, d
+	}
+
+	if tt := d.Requirements.TargetType; tt != "" && string(d.Target.VolumeType) != tt {
+		reason := d.Rejected[tt]
+		log.Printf("Volume %s in %s can't be converted to the required %s volume type: %s\n",
+			*v.VolumeId, v.region, tt, reason)
+		vr.needsReview(fmt.Sprintf("the required %s volume type can't be used: %s", tt, reason))
+		return vr, d
+	}
+
+	if !d.Requirements.meetsMinimums(&d.Target) {
+		log.Printf("No configuration of volume %s in %s meets the minimums required by its tags\n", *v.VolumeId, v.region)
+		vr.needsReview(fmt.Sprintf("no configuration delivers the %d IOPS and %dMiB/s required by the %s and %s tags",
+			d.Requirements.MinIOPS, d.Requirements.MinThroughput, MinIOPSTag, MinThroughputTag))
+		return vr, d
+	}
+
+	if !d.changed() {
 		log.Printf("Volume configuration unchanged, skipping volume %s in %s\n", *v.VolumeId, v.region)
-		return nil
+		vr.skip("the current configuration is the cheapest one meeting the requirements")
+		return vr, d
+	}
+
+	if conf.GP2BurstCheck && d.Current.VolumeType == "gp2" {
+		checked, br := v.checkBurst(d)
+		vr.Burst = br
+		if checked == nil {
+			vr.setTarget(&d.Target)
+			vr.needsReview(fmt.Sprintf("converting to %s would throttle the demand of %d IOPS and %dMiB/s",
+				d.Target.toString(), br.DemandIOPS, br.DemandThroughput))
+			return vr, d
+		}
+		d = checked
+		vr.Candidates = d.Candidates
+	}
+	log.Printf("Current volume configuration for %s in %s: %+v, new volume configuration: %+v \n", *v.VolumeId, v.region, d.Current, d.Target)
+
+	vr.setTarget(&d.Target)
+	vr.Action = ActionPlanned
+	vr.Reason = fmt.Sprintf("the cheapest configuration, saving $%.2f/month", vr.MonthlyCostBefore-vr.MonthlyCostAfter)
+	if vr.Overrides != nil || vr.Policy != nil {
+		vr.Reason = fmt.Sprintf("the cheapest configuration meeting the policy and the override tags, changing the cost from $%.2f to $%.2f/month",
+			vr.MonthlyCostBefore, vr.MonthlyCostAfter)
+	}
+
+	eligibleAt, reason, err := v.eligibility()
+	if err != nil {
+		log.Printf("Couldn't schedule the modification of volume %s in %s: %s\n", *v.VolumeId, v.region, err.Error())
+		vr.needsReview(err.Error())
+		return vr, d
 	}
-	log.Printf("Current volume configuration for %s in %s: %+v, new volume configuration: %+v \n", *v.VolumeId, v.region, vc, nvc)
-	return v.modify(&nvc)
+	if eligibleAt.After(time.Now()) {
+		vr.EligibleAt = &eligibleAt
+		vr.Reason += fmt.Sprintf(", eligible at %s since it's %s", eligibleAt.Format(time.RFC3339), reason)
+	}
+	return vr, d
 }
 
+// process converts the volume to the configuration decided by plan. The
+// volumes which can't be modified yet are reported as deferred, without being
+// queued, since every later execution plans them again.
+func (v *EBSVolume) process() *volumeReport {
+
+	vr, d := v.plan()
+	if vr.Action != ActionPlanned {
+		return vr
+	}
+
+	if vr.EligibleAt != nil {
+		eligibleAt := *vr.EligibleAt
+		log.Printf("Volume %s in %s can't be modified yet, deferring it until %s\n",
+			*v.VolumeId, v.region, eligibleAt.Format(time.RFC3339))
+		vr.deferUntil(eligibleAt, vr.Reason+", left to a later execution")
+		return vr
+	}
+
+	if err := v.modify(&d.Target); err != nil {
+		vr.fail(err)
+		return vr
+	}
+	vr.applied(fmt.Sprintf("converted to the cheapest configuration, saving $%.2f/month",
+		vr.MonthlyCostBefore-vr.MonthlyCostAfter))
+	return vr
+}
+
+// modify converts the volume to the given configuration, applying its volume
+// type, IOPS and throughput together after validating them.
 func (v *EBSVolume) modify(config *volumeConfig) error {
 
-	v.backupConfiguration()
+	if err := config.validate(); err != nil {
+		log.Printf("Invalid target configuration %+v for volume %s in %s: %s\n",
+			config, *v.VolumeId, v.region, err.Error())
+		return fmt.Errorf("invalid target configuration for volume %s: %w", *v.VolumeId, err)
+	}
+
+	if err := v.backupConfiguration(); err != nil {
+		log.Printf("Couldn't back up the configuration of volume %s in %s, not modifying it: %s\n",
+			*v.VolumeId, v.region, err.Error())
+		return fmt.Errorf("couldn't back up the configuration of volume %s, not modifying it: %w", *v.VolumeId, err)
+	}
 
 	if conf.DryRun {
-		log.Printf("Dry-run: would modify volume %+v from %s to %s\n",
-			*v.VolumeId, v.VolumeType, config.VolumeType)
+		log.Printf("Dry-run: would modify volume %+v from %+v to %+v\n",
+			*v.VolumeId, v.getCurrentConfiguration(), config)
 		return nil
 	}
 
-	_, err := v.api.ec2.ModifyVolume(context.TODO(), &ec2.ModifyVolumeInput{
-		VolumeId:   v.VolumeId,
-		VolumeType: config.VolumeType,
-	})
+	_, err := v.api.ec2.ModifyVolume(context.TODO(), config.modifyVolumeInput(v.VolumeId))
 
 	if err != nil {
 		log.Println("Couldn't modify volume", *v.VolumeId, err.Error())
 		return err
 	}
 
+	if err := v.recordHistory(config); err != nil {
+		// not failing the volume, since it was already modified
+		log.Printf("Couldn't record the new configuration of volume %s in its history: %s\n", *v.VolumeId, err.Error())
+	}
 	return nil
 }
 
 func (v *EBSVolume) getCurrentConfiguration() *volumeConfig {
 	vc := volumeConfig{
 		VolumeType: v.VolumeType,
-		IOPS:       *v.Iops,
+		IOPS:       v.getIOPS(),
 		Throughput: v.getThroughput(),
 		Region:     v.region,
 		Size:       *v.Size,
@@ -68,21 +197,120 @@ func (v *EBSVolume) getCurrentConfiguration() *volumeConfig {
 }
 
 func (v *EBSVolume) getInitialConfiguration() *volumeConfig {
-	var vc volumeConfig
-	for _, tag := range v.Tags {
-		if *tag.Key == InitialConfigurationTag {
-			val := *tag.Value
-			err := json.Unmarshal([]byte(val), &vc)
-			if err != nil {
-				fmt.Println("error unmarshalling initial configuration tag:", err)
-			}
-			vc.Region, vc.Size = v.region, *v.Size
-			return &vc
-		}
+	return v.getConfigurationBackup(InitialConfigurationTag)
+}
+
+func (v *EBSVolume) getPreviousConfiguration() *volumeConfig {
+	return v.getConfigurationBackup(PreviousConfigurationTag)
+}
+
+// getConfigurationBackup loads the configuration backed up under the given key
+// from the backup store, or returns nil if it's missing or can't be loaded.
+func (v *EBSVolume) getConfigurationBackup(key string) *volumeConfig {
+	vc, err := backups.load(v, key)
+	if err != nil {
+		log.Printf("Couldn't load the %s backup of volume %s: %s\n", key, *v.VolumeId, err.Error())
+		return nil
+	}
+	if vc == nil {
+		return nil
+	}
+	vc.Region, vc.Size = v.region, *v.Size
+	return vc
+}
+
+// rollback restores the configuration backed up in the tag corresponding to the
+// given rollback target.
+func (v *EBSVolume) rollback(to string) *volumeReport {
+	var rc *volumeConfig
+
+	vr := newVolumeReport(v)
+
+	if !v.checkOverrides(vr) {
+		return vr
+	}
+
+	switch to {
+	case RollbackToInitial:
+		rc = v.getInitialConfiguration()
+	case RollbackToPrevious:
+		rc = v.getPreviousConfiguration()
+	default:
+		vr.fail(fmt.Errorf("unknown rollback target %q", to))
+		return vr
+	}
+
+	if rc == nil {
+		log.Printf("Missing %s configuration backup, skipping volume %s in %s\n", to, *v.VolumeId, v.region)
+		vr.skip(fmt.Sprintf("missing %s configuration backup", to))
+		return vr
+	}
+
+	if vr.Current.equals(rc) {
+		log.Printf("Volume %s in %s already has the %s configuration, skipping it\n", *v.VolumeId, v.region, to)
+		vr.skip(fmt.Sprintf("already has the %s configuration", to))
+		return vr
+	}
+
+	log.Printf("Rolling back volume %s in %s from %+v to the %s configuration %+v\n", *v.VolumeId, v.region, vr.Current, to, rc)
+
+	vr.setTarget(rc)
+	if eligibleAt, inCooldown := v.cooldownEnd(); inCooldown {
+		log.Printf("Volume %s in %s was modified recently, deferring its rollback until %s\n",
+			*v.VolumeId, v.region, eligibleAt.Format(time.RFC3339))
+		vr.deferUntil(eligibleAt, "in the modification cooldown")
+		return vr
+	}
+	if err := v.modify(rc); err != nil {
+		vr.fail(err)
+		return vr
+	}
+	vr.applied(fmt.Sprintf("rolled back to the %s configuration", to))
+	return vr
+}
+
+// restorePreviousConfiguration converts the volume back to the configuration
+// backed up in the PreviousConfigurationTag, without backing up the current
+// configuration which would overwrite it.
+func (v *EBSVolume) restorePreviousConfiguration() error {
+
+	resp, err := v.api.ec2.DescribeVolumes(context.TODO(), &ec2.DescribeVolumesInput{
+		VolumeIds: []string{*v.VolumeId},
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Volumes) == 0 {
+		return fmt.Errorf("volume %s not found", *v.VolumeId)
+	}
+	v.Volume = resp.Volumes[0]
+
+	pc := v.getPreviousConfiguration()
+	if pc == nil {
+		return fmt.Errorf("missing previous configuration backup")
+	}
+	if err := pc.validate(); err != nil {
+		return fmt.Errorf("invalid previous configuration: %w", err)
+	}
+
+	log.Printf("Rolling back volume %s in %s to the previous configuration %+v\n", *v.VolumeId, v.region, pc)
+	if _, err = v.api.ec2.ModifyVolume(context.TODO(), pc.modifyVolumeInput(v.VolumeId)); err != nil {
+		return err
+	}
+
+	if err := v.recordHistory(pc); err != nil {
+		log.Printf("Couldn't record the restored configuration of volume %s in its history: %s\n", *v.VolumeId, err.Error())
 	}
 	return nil
 }
 
+func (v *EBSVolume) getIOPS() int32 {
+	if v.Iops == nil {
+		return 0
+	}
+	return *v.Iops
+}
+
 func (v *EBSVolume) getThroughput() int32 {
 	if v.Throughput == nil {
 		return 0
@@ -90,77 +318,97 @@ func (v *EBSVolume) getThroughput() int32 {
 	return *v.Throughput
 }
 
-func (v *EBSVolume) newVolumeConfiguration() volumeConfig {
-	var nvc volumeConfig
-	// by default give the same configuration as original volume
-	nvc.VolumeType = v.VolumeType
-
-	if string(v.VolumeType) == "gp2" {
-		nvc.VolumeType = "gp3" // always makes sense to convert to GP3 as per https://cloudwiry.com/ebs-gp3-vs-gp2-pricing-comparison/
-		if *v.Size > 1000 && conf.GP3MatchGP2IOPS {
-			nvc.IOPS = *v.Size * 3 // match GP2 IOPS for large volumes
-		}
-		if *v.Size > 170 && conf.GP3MatchGP2BurstThroughput {
-			nvc.Throughput = 250 // match GP2 burstable throughput for smaller volumes
+// isBootVolume checks if the volume is attached as the root device of its
+// instance. When the instance can't be looked up, for example without the
+// ec2:DescribeInstances permission, it falls back to the device names commonly
+// used for the root volume.
+func (v *EBSVolume) isBootVolume() bool {
+	for _, a := range v.Attachments {
+		device := aws.ToString(a.Device)
+
+		i, err := v.api.instance(aws.ToString(a.InstanceId))
+		if err == nil {
+			if device == aws.ToString(i.RootDeviceName) {
+				return true
+			}
+			continue
 		}
-	}
+		debug.Println("Couldn't look up instance", aws.ToString(a.InstanceId), err,
+			"guessing the root device from the device name", device)
 
-	// convert io1 to io2 in supported regions
-	if string(v.VolumeType) == "io1" && io2Supports(v.region) {
-		nvc.VolumeType = "io2"
-	}
-
-	// convert IO1 and IO2 volumes to gp3 if their PIOPS is smaller than the max GP3 PIOPS
-	if (string(v.VolumeType) == "io1" || string(v.VolumeType) == "io2") && *v.Iops < 16000 {
-		nvc.VolumeType = "gp3"
-		nvc.IOPS = *v.Iops
-		nvc.Throughput = *v.Throughput
+		switch device {
+		case "/dev/xvda", "/dev/sda", "/dev/sda1":
+			return true
+		}
 	}
-
-	return nvc
+	return false
 }
 
-func (v *EBSVolume) backupConfiguration() {
-	log.Println("Backing up configuration to tags")
-	if !v.hasInitialConfigurationBackup() {
+// backupConfiguration stores the current configuration of the volume in the
+// backup store, which is a precondition for modifying it. The history is only
+// informative, so failing to record it doesn't prevent the modification.
+func (v *EBSVolume) backupConfiguration() error {
+	log.Println("Backing up configuration")
+	hasInitial, err := v.hasInitialConfigurationBackup()
+	if err != nil {
+		return err
+	}
+	if !hasInitial {
 		log.Println("Missing initial configuration, backing it up")
-		v.backupInitialConfiguration()
+		if err := v.backupInitialConfiguration(); err != nil {
+			return err
+		}
 	}
 	log.Println("Backing up current configuration")
-	v.backupCurrentConfigurationAsPrevious()
+	if err := v.backupCurrentConfigurationAsPrevious(); err != nil {
+		return err
+	}
+	if !v.hasHistory() {
+		log.Println("Missing configuration history, recording the current configuration")
+		if err := v.recordHistory(v.getCurrentConfiguration()); err != nil {
+			log.Printf("WARNING: couldn't record the current configuration of volume %s in its history: %s\n", *v.VolumeId, err.Error())
+		}
+	}
+	return nil
 }
 
-func (v *EBSVolume) backupInitialConfiguration() {
-	v.saveConfigurationToTag(InitialConfigurationTag)
+func (v *EBSVolume) backupInitialConfiguration() error {
+	return v.saveConfiguration(InitialConfigurationTag)
 }
 
-func (v *EBSVolume) backupCurrentConfigurationAsPrevious() {
-	v.saveConfigurationToTag(PreviousConfigurationTag)
+func (v *EBSVolume) backupCurrentConfigurationAsPrevious() error {
+	return v.saveConfiguration(PreviousConfigurationTag)
 }
 
-func (v *EBSVolume) hasInitialConfigurationBackup() bool {
-	for _, tag := range v.Tags {
-		if *tag.Key == InitialConfigurationTag {
-			return true
-		}
+// hasInitialConfigurationBackup checks the backup store for the initial
+// configuration, failing if the store can't be read so that an existing
+// backup is never overwritten.
+func (v *EBSVolume) hasInitialConfigurationBackup() (bool, error) {
+	vc, err := backups.load(v, InitialConfigurationTag)
+	if err != nil {
+		return false, fmt.Errorf("couldn't check the %s backup: %w", InitialConfigurationTag, err)
 	}
-	return false
+	return vc != nil, nil
 }
 
-func (v *EBSVolume) saveConfigurationToTag(key string) {
+// saveConfiguration stores the current configuration under the given key.
+func (v *EBSVolume) saveConfiguration(key string) error {
 	vc := v.getCurrentConfiguration()
 	log.Printf("Current configuration for %s: %v", *v.VolumeId, vc)
 
-	value := vc.toString()
-	debug.Printf("Configuration %v converted to string: %s\n", vc, value)
-
 	if conf.DryRun {
-		log.Printf("Dry-run: would modify volume %s tag %s to %s\n",
-			*v.VolumeId, key, value)
-		return
+		log.Printf("Dry-run: would back up volume %s configuration %s to %s\n",
+			*v.VolumeId, vc.toString(), key)
+		return nil
 	}
 
-	v.api.ec2.CreateTags(context.TODO(), &ec2.CreateTagsInput{
+	return backups.save(v, key, vc)
+}
+
+// writeTag sets the tag on the volume, and then reads it back for confirming
+// that it was persisted.
+func (v *EBSVolume) writeTag(key, value string) error {
+	_, err := v.api.ec2.CreateTags(context.TODO(), &ec2.CreateTagsInput{
 		Resources: []string{*v.VolumeId},
 		Tags: []types.Tag{
 			{
@@ -169,6 +417,58 @@ func (v *EBSVolume) saveConfigurationToTag(key string) {
 			},
 		},
 	})
+	if err != nil {
+		return fmt.Errorf("couldn't write the %s tag: %w", key, err)
+	}
+
+	if err := v.verifyTag(key, value); err != nil {
+		return err
+	}
+	v.setTag(key, value)
+	return nil
+}
+
+// verifyTag confirms that the tag has the expected value, retrying a few times
+// since the tags are eventually consistent.
+func (v *EBSVolume) verifyTag(key, value string) error {
+	var actual string
+
+	for attempt := 1; attempt <= tagVerificationAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(tagVerificationDelay * conf.SleepMultiplier)
+		}
+
+		resp, err := v.api.ec2.DescribeTags(context.TODO(), &ec2.DescribeTagsInput{
+			Filters: []types.Filter{
+				{Name: aws.String("resource-id"), Values: []string{*v.VolumeId}},
+				{Name: aws.String("key"), Values: []string{key}},
+			},
+		})
+		if err != nil {
+			debug.Printf("Couldn't read back the %s tag of %s: %s\n", key, *v.VolumeId, err.Error())
+			continue
+		}
+
+		for _, tag := range resp.Tags {
+			actual = aws.ToString(tag.Value)
+		}
+		if actual == value {
+			debug.Printf("Confirmed the %s tag of %s\n", key, *v.VolumeId)
+			return nil
+		}
+	}
+	return fmt.Errorf("couldn't confirm the %s tag, expected %q but found %q", key, value, actual)
+}
+
+// setTag updates the tag in the local copy of the volume data.
+func (v *EBSVolume) setTag(key, value string) {
+	for i, tag := range v.Tags {
+		if *tag.Key == key {
+			v.Tags[i].Value = aws.String(value)
+			return
+		}
+	}
+	v.Tags = append(v.Tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
 }
 
 func (v *EBSVolume) calculateMonthlySavings() float64 {
@@ -196,3 +496,17 @@ func (v *EBSVolume) calculateMonthlySavings() float64 {
 func (v *EBSVolume) calculateHourlySavings() float64 {
 	return v.calculateMonthlySavings() / 730
 }
+
+func min32(a, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max32(a, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
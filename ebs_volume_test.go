@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestIsBootVolume(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance string
+		device   string
+		want     bool
+	}{
+		{"root device", "i-nitro", "/dev/sda1", true},
+		{"data volume on a common root device name", "i-xen", "/dev/sda1", false},
+		{"root device with an unusual name", "i-xen", "/dev/xvdz", true},
+		{"unknown instance, common root device name", "i-missing", "/dev/xvda", true},
+		{"unknown instance, data device name", "i-missing", "/dev/sdf", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := testVolume("gp2", 100, 300, 0)
+			v.api.instanceCache.add(
+				types.Instance{InstanceId: aws.String("i-nitro"), RootDeviceName: aws.String("/dev/sda1")},
+				types.Instance{InstanceId: aws.String("i-xen"), RootDeviceName: aws.String("/dev/xvdz")},
+			)
+			v.Attachments = []types.VolumeAttachment{{InstanceId: aws.String(tt.instance), Device: aws.String(tt.device)}}
+
+			if got := v.isBootVolume(); got != tt.want {
+				t.Errorf("isBootVolume() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
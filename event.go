@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// eventData stores the parameters that can be passed in the Lambda invocation
+// event, overriding the values given as command line flags or environment
+// variables for the duration of a single execution.
+type eventData struct {
+	Mode       string `json:"mode"`
+	RollbackTo string `json:"rollback_to"`
+	PlanFile   string `json:"plan_file"`
+	Regions    string `json:"regions"`
+	Volumes    string `json:"volumes"`
+	DryRun     *bool  `json:"dry_run"`
+
+	TagFilters       string `json:"tag_filters"`
+	TagFilteringMode string `json:"tag_filtering_mode"`
+
+	VolumeTypes  string `json:"volume_types"`
+	VolumeStates string `json:"volume_states"`
+}
+
+func (c *Config) applyEvent(event *json.RawMessage) {
+	if event == nil || len(*event) == 0 {
+		return
+	}
+
+	var ed eventData
+	if err := json.Unmarshal(*event, &ed); err != nil {
+		debug.Println("Couldn't parse event data, ignoring it:", err.Error())
+		return
+	}
+
+	if ed.Mode != "" {
+		c.Mode = ed.Mode
+	}
+	if ed.RollbackTo != "" {
+		c.RollbackTo = ed.RollbackTo
+	}
+	if ed.PlanFile != "" {
+		c.PlanFile = ed.PlanFile
+	}
+	if ed.Regions != "" {
+		c.Regions = ed.Regions
+	}
+	if ed.Volumes != "" {
+		c.Volumes = ed.Volumes
+	}
+	if ed.DryRun != nil {
+		c.DryRun = *ed.DryRun
+	}
+	if ed.TagFilters != "" {
+		c.FilterByTags = ed.TagFilters
+	}
+	if ed.TagFilteringMode != "" {
+		c.TagFilteringMode = ed.TagFilteringMode
+	}
+	if ed.VolumeTypes != "" {
+		c.VolumeTypes = ed.VolumeTypes
+	}
+	if ed.VolumeStates != "" {
+		c.VolumeStates = ed.VolumeStates
+	}
+	log.Printf("Configuration after applying the event data: mode=%s rollback_to=%s plan_file=%s regions=%q volumes=%q dry_run=%v tag_filters=%q tag_filtering_mode=%s volume_types=%q volume_states=%q",
+		c.Mode, c.RollbackTo, c.PlanFile, c.Regions, c.Volumes, c.DryRun, c.FilterByTags, c.TagFilteringMode, c.VolumeTypes, c.VolumeStates)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// maxTagValueLength is the maximum length of an EC2 tag value.
+const maxTagValueLength = 256
+
+// maxTagsPerResource is the number of tags allowed per EC2 resource.
+const maxTagsPerResource = 50
+
+// maxHistorySize leaves room for the other tags of the volume, out of the
+// maxTagsPerResource. The history is further limited to the tags still
+// available on each volume.
+const maxHistorySize = 40
+
+// historyEntry is a configuration the volume had at some point, and the
+// execution which applied it. The JSON keys are kept short for fitting an
+// entry into a tag value.
+type historyEntry struct {
+	Seq     int           `json:"n"`
+	Time    time.Time     `json:"t"`
+	Version string        `json:"v,omitempty"`
+	RunID   string        `json:"r,omitempty"`
+	Config  historyConfig `json:"c"`
+}
+
+// historyConfig is the compact form of a volumeConfig, without the region.
+type historyConfig struct {
+	VolumeType types.VolumeType `json:"vt"`
+	IOPS       int32            `json:"i,omitempty"`
+	Throughput int32            `json:"tp,omitempty"`
+	Size       int32            `json:"s"`
+}
+
+func newHistoryEntry(vc *volumeConfig) historyEntry {
+	return historyEntry{
+		Time:    time.Now().UTC().Truncate(time.Second),
+		Version: conf.Version,
+		RunID:   conf.RunID,
+		Config: historyConfig{
+			VolumeType: vc.VolumeType,
+			IOPS:       vc.IOPS,
+			Throughput: vc.Throughput,
+			Size:       vc.Size,
+		},
+	}
+}
+
+func (he historyEntry) toString() string {
+	return fmt.Sprintf("#%d %s version=%s run=%s type=%s size=%d iops=%d throughput=%d",
+		he.Seq, he.Time.Format(time.RFC3339), he.Version, he.RunID,
+		he.Config.VolumeType, he.Config.Size, he.Config.IOPS, he.Config.Throughput)
+}
+
+// historyStore persists the configuration history of the volumes.
+type historyStore interface {
+	// append adds the entry to the history of the volume, setting its
+	// sequence number.
+	append(v *EBSVolume, entry historyEntry) error
+
+	// list returns the history of the volume, oldest entry first.
+	list(v *EBSVolume) ([]historyEntry, error)
+}
+
+// tagHistoryStore keeps the last entries of the history in rotating numbered
+// tags of the volume.
+type tagHistoryStore struct {
+	size int
+}
+
+func newTagHistoryStore(size int) *tagHistoryStore {
+	if size < 1 {
+		size = 1
+	}
+	if size > maxHistorySize {
+		log.Printf("History size %d exceeds the maximum of %d, using the maximum\n", size, maxHistorySize)
+		size = maxHistorySize
+	}
+	return &tagHistoryStore{size: size}
+}
+
+// entries returns the valid history entries of the volume by tag key.
+func (s *tagHistoryStore) entries(v *EBSVolume) map[string]historyEntry {
+	entries := make(map[string]historyEntry)
+
+	for _, tag := range v.Tags {
+		key := aws.ToString(tag.Key)
+		if !strings.HasPrefix(key, HistoryTagPrefix) {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimPrefix(key, HistoryTagPrefix)); err != nil {
+			continue
+		}
+
+		var he historyEntry
+		if err := json.Unmarshal([]byte(aws.ToString(tag.Value)), &he); err != nil {
+			log.Printf("Ignoring invalid %s tag of volume %s: %s\n", key, *v.VolumeId, err.Error())
+			continue
+		}
+		entries[key] = he
+	}
+	return entries
+}
+
+func (s *tagHistoryStore) list(v *EBSVolume) ([]historyEntry, error) {
+	var entries []historyEntry
+	for _, he := range s.entries(v) {
+		entries = append(entries, he)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+	return entries, nil
+}
+
+// tagKey returns the tag for the history entry with the given sequence number,
+// rotating over history_size tags. When the volume has no free tag left, the
+// tag of the oldest entry is reused instead, so the history is limited to the
+// tags it already has.
+func (s *tagHistoryStore) tagKey(v *EBSVolume, seq int) (string, error) {
+	key := fmt.Sprintf("%s%d", HistoryTagPrefix, seq%s.size)
+	if _, found := tagValue(v.Tags, key); found || len(v.Tags) < maxTagsPerResource {
+		return key, nil
+	}
+
+	oldest := ""
+	entries := s.entries(v)
+	for k, he := range entries {
+		if oldest == "" || he.Seq < entries[oldest].Seq {
+			oldest = k
+		}
+	}
+	if oldest == "" {
+		return "", fmt.Errorf("no tag available for the history, the volume already has %d tags", len(v.Tags))
+	}
+	debug.Printf("Volume %s has no free tag left, replacing its history tag %s\n", *v.VolumeId, oldest)
+	return oldest, nil
+}
+
+func (s *tagHistoryStore) append(v *EBSVolume, entry historyEntry) error {
+	entries, err := s.list(v)
+	if err != nil {
+		return err
+	}
+
+	entry.Seq = 1
+	if len(entries) > 0 {
+		entry.Seq = entries[len(entries)-1].Seq + 1
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if excess := len(data) - maxTagValueLength; excess > 0 {
+		// the version is the only field of arbitrary length
+		if excess > len(entry.Version) {
+			return fmt.Errorf("history entry %s exceeds the tag size limit", data)
+		}
+		entry.Version = entry.Version[:len(entry.Version)-excess]
+		if data, err = json.Marshal(entry); err != nil {
+			return err
+		}
+	}
+
+	key, err := s.tagKey(v, entry.Seq)
+	if err != nil {
+		return err
+	}
+	return v.writeTag(key, string(data))
+}
+
+// history is the store used for the configuration history of the volumes,
+// set up by Init along with the backup store.
+var history historyStore
+
+// recordHistory appends the configuration to the history of the volume.
+func (v *EBSVolume) recordHistory(vc *volumeConfig) error {
+	debug.Printf("Recording configuration %v in the history of %s\n", vc, *v.VolumeId)
+	if conf.DryRun {
+		log.Printf("Dry-run: would record configuration %s in the history of volume %s\n", vc.toString(), *v.VolumeId)
+		return nil
+	}
+	return history.append(v, newHistoryEntry(vc))
+}
+
+// hasHistory checks whether the volume has any configuration history.
+func (v *EBSVolume) hasHistory() bool {
+	entries, err := history.list(v)
+	return err == nil && len(entries) > 0
+}
+
+// printHistory writes the configuration history of the volumes from the
+// enabled regions to stdout.
+func (e *EBSOptimizer) printHistory(regions []string, report *runReport) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+
+	histories := make(map[string][]string)
+
+	for _, reg := range regions {
+
+		r := region{name: reg, conf: e.config, filter: e.filter, report: &regionReport{Region: reg, Enabled: true}}
+
+		if !r.enabled() {
+			debug.Println("Not enabled to run in", r.name)
+			continue
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			r.api.connect(r.name, r.conf.MainRegion)
+
+			inv := r.inventory()
+			_, inTags := history.(*tagHistoryStore)
+			if len(r.conf.volumeIDs()) == 0 && inTags {
+				// only the volumes which have a history
+				inv.filters = append(inv.filters, types.Filter{
+					Name:   aws.String("tag-key"),
+					Values: []string{HistoryTagPrefix + "*"},
+				})
+			}
+
+			var lines []string
+			err := inv.forEach(func(v *EBSVolume) error {
+				entries, err := history.list(v)
+				if err != nil {
+					return err
+				}
+				lines = append(lines, fmt.Sprintf("%s (%s): %d entries", *v.VolumeId, r.name, len(entries)))
+				for _, he := range entries {
+					lines = append(lines, "  "+he.toString())
+				}
+				return nil
+			})
+			if err != nil {
+				log.Printf("Failed reading the history of the volumes in %s: %s", r.name, err.Error())
+				r.report.Error = err.Error()
+			}
+
+			mutex.Lock()
+			histories[r.name] = lines
+			mutex.Unlock()
+			report.addRegion(r.report)
+		}()
+	}
+	wg.Wait()
+
+	var names []string
+	for name := range histories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, line := range histories[name] {
+			fmt.Fprintln(os.Stdout, line)
+		}
+	}
+}
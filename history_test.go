@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// volumeWithTags returns a volume with the given number of unrelated tags and
+// history tags, the history entries having the sequence numbers 1 to n.
+func volumeWithTags(others, historyEntries, historySize int) *EBSVolume {
+	v := testVolume("gp2", 100, 300, 0)
+	for i := 0; i < others; i++ {
+		v.Tags = append(v.Tags, types.Tag{Key: aws.String(fmt.Sprintf("tag%d", i)), Value: aws.String("x")})
+	}
+	for seq := 1; seq <= historyEntries; seq++ {
+		v.Tags = append(v.Tags, types.Tag{
+			Key:   aws.String(fmt.Sprintf("%s%d", HistoryTagPrefix, seq%historySize)),
+			Value: aws.String(fmt.Sprintf(`{"n":%d,"t":"2026-10-01T00:00:00Z","c":{"vt":"gp2","s":100}}`, seq)),
+		})
+	}
+	return v
+}
+
+func TestHistoryTagKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		others  int
+		entries int
+		size    int
+		want    string
+	}{
+		{"first entry", 0, 0, 10, HistoryTagPrefix + "1"},
+		{"next entry", 5, 3, 10, HistoryTagPrefix + "4"},
+		{"rotation", 5, 10, 10, HistoryTagPrefix + "1"},
+		{"last free tag", 49, 0, 10, HistoryTagPrefix + "1"},
+		{"no free tag, oldest entry replaced", 47, 3, 10, HistoryTagPrefix + "1"},
+		{"no free tag, rotating tag already present", 40, 10, 10, HistoryTagPrefix + "1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTagHistoryStore(tt.size)
+			v := volumeWithTags(tt.others, tt.entries, tt.size)
+
+			got, err := s.tagKey(v, tt.entries+1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("history entry %d written to %s, want %s", tt.entries+1, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistoryTagKeyWithoutFreeTags(t *testing.T) {
+	s := newTagHistoryStore(10)
+	if key, err := s.tagKey(volumeWithTags(50, 0, 10), 1); err == nil {
+		t.Errorf("history entry written to %s on a volume without free tags", key)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// instanceLimits is the maximum EBS performance an instance type can deliver
+// across all its volumes, with the throughput converted to MiB/s.
+type instanceLimits struct {
+	InstanceType  string `json:"instanceType"`
+	MaxIOPS       int32  `json:"maxIops"`
+	MaxThroughput int32  `json:"maxThroughput"`
+}
+
+// instanceClamp records the requirements of a volume lowered to the limits of
+// the instance it's attached to.
+type instanceClamp struct {
+	InstanceID string         `json:"instanceId"`
+	Limits     instanceLimits `json:"limits"`
+
+	// the requirements before clamping them
+	IOPS       int32 `json:"iops"`
+	Throughput int32 `json:"throughput"`
+}
+
+// instanceCache keeps the instances and the EBS limits of the instance types
+// looked up in a region, shared by all the volumes of the region.
+type instanceCache struct {
+	mutex     sync.Mutex
+	instances map[string]types.Instance
+	limits    map[types.InstanceType]*instanceLimits
+}
+
+func newInstanceCache() *instanceCache {
+	return &instanceCache{
+		instances: make(map[string]types.Instance),
+		limits:    make(map[types.InstanceType]*instanceLimits),
+	}
+}
+
+// add stores the instances, so that they're not looked up again.
+func (ic *instanceCache) add(instances ...types.Instance) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	for _, i := range instances {
+		ic.instances[aws.ToString(i.InstanceId)] = i
+	}
+}
+
+// instance looks up the instance, caching it.
+func (c *ec2Conn) instance(instanceID string) (*types.Instance, error) {
+	c.instanceCache.mutex.Lock()
+	i, found := c.instanceCache.instances[instanceID]
+	c.instanceCache.mutex.Unlock()
+	if found {
+		return &i, nil
+	}
+
+	if c.ec2 == nil {
+		return nil, fmt.Errorf("instance %s not found", instanceID)
+	}
+
+	resp, err := c.ec2.DescribeInstances(context.TODO(), &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range resp.Reservations {
+		c.instanceCache.add(r.Instances...)
+	}
+
+	c.instanceCache.mutex.Lock()
+	i, found = c.instanceCache.instances[instanceID]
+	c.instanceCache.mutex.Unlock()
+	if !found {
+		return nil, fmt.Errorf("instance %s not found", instanceID)
+	}
+	return &i, nil
+}
+
+// instanceType looks up the type of the instance.
+func (c *ec2Conn) instanceType(instanceID string) (types.InstanceType, error) {
+	i, err := c.instance(instanceID)
+	if err != nil {
+		return "", err
+	}
+	return i.InstanceType, nil
+}
+
+// instanceLimits looks up the EBS limits of the instance type, caching them.
+// It returns nil for the instance types without EBS optimization data.
+func (c *ec2Conn) instanceLimits(it types.InstanceType) (*instanceLimits, error) {
+	c.instanceCache.mutex.Lock()
+	limits, found := c.instanceCache.limits[it]
+	c.instanceCache.mutex.Unlock()
+	if found {
+		return limits, nil
+	}
+
+	if c.ec2 == nil {
+		return nil, nil
+	}
+
+	resp, err := c.ec2.DescribeInstanceTypes(context.TODO(), &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []types.InstanceType{it},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range resp.InstanceTypes {
+		if t.EbsInfo == nil || t.EbsInfo.EbsOptimizedInfo == nil {
+			continue
+		}
+		info := t.EbsInfo.EbsOptimizedInfo
+		limits = &instanceLimits{
+			InstanceType: string(it),
+			MaxIOPS:      aws.ToInt32(info.MaximumIops),
+			// the instance type throughput is given in MB/s
+			MaxThroughput: int32(aws.ToFloat64(info.MaximumThroughputInMBps) * 1000 * 1000 / 1024 / 1024),
+		}
+		debug.Printf("EBS limits of %s in %s: %+v\n", it, c.region, *limits)
+	}
+
+	c.instanceCache.mutex.Lock()
+	c.instanceCache.limits[it] = limits
+	c.instanceCache.mutex.Unlock()
+	return limits, nil
+}
+
+// clampToInstance lowers the IOPS and throughput requirements to the limits of
+// the instance the volume is attached to, since provisioning more than the
+// instance can use is wasted. For multi-attached volumes the highest limits
+// among the instances are used, so the requirements aren't clamped at all when
+// the limits of any of the instances are unknown, since that instance may
+// deliver more than the others.
+func (pe *performanceEnvelope) clampToInstance(v *EBSVolume) {
+	var clamp *instanceClamp
+	var ids, instanceTypes []string
+
+	for _, a := range v.Attachments {
+		id := aws.ToString(a.InstanceId)
+		if id == "" {
+			continue
+		}
+
+		it, err := v.api.instanceType(id)
+		if err != nil {
+			log.Printf("Couldn't look up the type of instance %s in %s: %s\n", id, v.region, err.Error())
+			return
+		}
+		limits, err := v.api.instanceLimits(it)
+		if err != nil {
+			log.Printf("Couldn't look up the EBS limits of %s in %s: %s\n", it, v.region, err.Error())
+			return
+		}
+		if limits == nil || limits.MaxIOPS == 0 || limits.MaxThroughput == 0 {
+			debug.Printf("Unknown EBS limits of %s instance %s in %s, not clamping the requirements of volume %s\n",
+				it, id, v.region, *v.VolumeId)
+			return
+		}
+		if clamp == nil {
+			clamp = &instanceClamp{Limits: *limits}
+		}
+		clamp.Limits.MaxIOPS = max32(clamp.Limits.MaxIOPS, limits.MaxIOPS)
+		clamp.Limits.MaxThroughput = max32(clamp.Limits.MaxThroughput, limits.MaxThroughput)
+		ids, instanceTypes = append(ids, id), append(instanceTypes, string(it))
+	}
+
+	if clamp == nil || (pe.IOPS <= clamp.Limits.MaxIOPS && pe.Throughput <= clamp.Limits.MaxThroughput) {
+		return
+	}
+
+	clamp.InstanceID = strings.Join(ids, ",")
+	clamp.Limits.InstanceType = strings.Join(instanceTypes, ",")
+	clamp.IOPS, clamp.Throughput = pe.IOPS, pe.Throughput
+	pe.IOPS = min32(pe.IOPS, clamp.Limits.MaxIOPS)
+	pe.Throughput = min32(pe.Throughput, clamp.Limits.MaxThroughput)
+	pe.InstanceClamp = clamp
+
+	log.Printf("Clamped the requirements of volume %s in %s from %d IOPS and %dMiB/s to %d IOPS and %dMiB/s, the limits of %s instance %s\n",
+		*v.VolumeId, v.region, clamp.IOPS, clamp.Throughput, pe.IOPS, pe.Throughput, clamp.Limits.InstanceType, clamp.InstanceID)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestClampToInstance(t *testing.T) {
+	tests := []struct {
+		name           string
+		instances      map[string]types.InstanceType
+		iops           int32
+		throughput     int32
+		wantIOPS       int32
+		wantThroughput int32
+		wantInstances  string
+	}{
+		{
+			name:           "within the instance limits",
+			instances:      map[string]types.InstanceType{"i-small": "t3.small"},
+			iops:           10000,
+			throughput:     150,
+			wantIOPS:       10000,
+			wantThroughput: 150,
+		},
+		{
+			name:           "above the instance limits",
+			instances:      map[string]types.InstanceType{"i-small": "t3.small"},
+			iops:           16000,
+			throughput:     1000,
+			wantIOPS:       11800,
+			wantThroughput: 165,
+			wantInstances:  "i-small",
+		},
+		{
+			name:           "multi-attached, clamped to the highest limits",
+			instances:      map[string]types.InstanceType{"i-small": "t3.small", "i-large": "m5.large"},
+			iops:           20000,
+			throughput:     1000,
+			wantIOPS:       18750,
+			wantThroughput: 596,
+			wantInstances:  "i-large,i-small",
+		},
+		{
+			name:           "multi-attached, within the limits of the larger instance",
+			instances:      map[string]types.InstanceType{"i-small": "t3.small", "i-large": "m5.large"},
+			iops:           16000,
+			throughput:     400,
+			wantIOPS:       16000,
+			wantThroughput: 400,
+		},
+		{
+			name:           "multi-attached, one instance with unknown limits",
+			instances:      map[string]types.InstanceType{"i-small": "t3.small", "i-other": "x9.unknown"},
+			iops:           16000,
+			throughput:     1000,
+			wantIOPS:       16000,
+			wantThroughput: 1000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := testVolume("io2", 500, tt.iops, 0)
+			v.api.instanceCache.limits["t3.small"] = &instanceLimits{InstanceType: "t3.small", MaxIOPS: 11800, MaxThroughput: 165}
+			v.api.instanceCache.limits["m5.large"] = &instanceLimits{InstanceType: "m5.large", MaxIOPS: 18750, MaxThroughput: 596}
+
+			// sorted, for the instance IDs recorded in the clamp
+			for _, id := range []string{"i-large", "i-other", "i-small"} {
+				it, found := tt.instances[id]
+				if !found {
+					continue
+				}
+				v.api.instanceCache.add(types.Instance{InstanceId: aws.String(id), InstanceType: it})
+				v.Attachments = append(v.Attachments, types.VolumeAttachment{InstanceId: aws.String(id)})
+			}
+
+			pe := &performanceEnvelope{IOPS: tt.iops, Throughput: tt.throughput}
+			pe.clampToInstance(v)
+
+			if pe.IOPS != tt.wantIOPS || pe.Throughput != tt.wantThroughput {
+				t.Errorf("clamped to %d IOPS and %dMiB/s, want %d IOPS and %dMiB/s",
+					pe.IOPS, pe.Throughput, tt.wantIOPS, tt.wantThroughput)
+			}
+			if tt.wantInstances == "" {
+				if pe.InstanceClamp != nil {
+					t.Errorf("recorded the clamp %+v", pe.InstanceClamp)
+				}
+				return
+			}
+			if pe.InstanceClamp == nil || pe.InstanceClamp.InstanceID != tt.wantInstances ||
+				pe.InstanceClamp.IOPS != tt.iops || pe.InstanceClamp.Throughput != tt.throughput {
+				t.Errorf("recorded the clamp %+v, want the one of %s", pe.InstanceClamp, tt.wantInstances)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// inventoryPageSize is the number of volumes fetched per DescribeVolumes call,
+// which is also the maximum number of volumes kept in memory at any time.
+const inventoryPageSize = 500
+
+// volumeIDsPerFilter limits the number of volume IDs passed to a single
+// volume-id filter when querying a known list of volumes.
+const volumeIDsPerFilter = 200
+
+// inventory lists the EBS volumes of a region page by page, filtering them on
+// the server side where possible and on the client side with the tag filters
+// which can't be evaluated by EC2.
+type inventory struct {
+	api     ec2Conn
+	region  string
+	filters []types.Filter
+	filter  *volumeFilter
+
+	// the volumes to list, if known, queried volumeIDsPerFilter at a time
+	volumeIDs []string
+
+	// optionally called for every listed volume, before the tag filters
+	listed func(v *EBSVolume)
+
+	// optionally called for the listed volumes excluded by the tag filters
+	// on the client side
+	excluded func(v *EBSVolume, reason string)
+}
+
+func (r *region) inventory() *inventory {
+	var filters []types.Filter
+
+	if volumeTypes := splitList(r.conf.VolumeTypes); len(volumeTypes) > 0 {
+		filters = append(filters, types.Filter{
+			Name:   aws.String("volume-type"),
+			Values: volumeTypes,
+		})
+	}
+
+	if states := splitList(r.conf.VolumeStates); len(states) > 0 {
+		filters = append(filters, types.Filter{
+			Name:   aws.String("status"),
+			Values: states,
+		})
+	}
+
+	return &inventory{
+		api:       r.api,
+		region:    r.name,
+		filters:   filters,
+		filter:    r.filter,
+		volumeIDs: dedupe(r.conf.volumeIDs()),
+	}
+}
+
+// filtered checks if the inventory only lists some of the volumes of the
+// region on the server side.
+func (i *inventory) filtered() bool {
+	return len(i.filters) > 0 || len(i.volumeIDs) > 0
+}
+
+func dedupe(values []string) []string {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, v := range values {
+		if !seen[v] {
+			unique = append(unique, v)
+			seen[v] = true
+		}
+	}
+	return unique
+}
+
+// forEach calls fn for every volume included by the filters, as soon as the
+// page containing it was fetched. It stops at the first error returned by fn.
+func (i *inventory) forEach(fn func(*EBSVolume) error) error {
+	filters := i.filters
+	if i.filter != nil {
+		filters = append(filters[:len(filters):len(filters)], i.filter.ec2Filters()...)
+	}
+
+	if len(i.volumeIDs) == 0 {
+		return i.list(filters, fn)
+	}
+
+	for start := 0; start < len(i.volumeIDs); start += volumeIDsPerFilter {
+		end := start + volumeIDsPerFilter
+		if end > len(i.volumeIDs) {
+			end = len(i.volumeIDs)
+		}
+
+		// using a filter instead of VolumeIds, which fails for the volumes
+		// located in other regions
+		ids := types.Filter{
+			Name:   aws.String("volume-id"),
+			Values: i.volumeIDs[start:end],
+		}
+		if err := i.list(append([]types.Filter{ids}, filters...), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list calls fn for the volumes matching the server-side filters and included
+// by the tag filters.
+func (i *inventory) list(filters []types.Filter, fn func(*EBSVolume) error) error {
+	input := &ec2.DescribeVolumesInput{
+		Filters:    filters,
+		MaxResults: aws.Int32(inventoryPageSize),
+	}
+
+	paginator := ec2.NewDescribeVolumesPaginator(i.api.ec2, input)
+
+	for page := 1; paginator.HasMorePages(); page++ {
+		resp, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			log.Println("Could not scan volumes", err.Error())
+			return err
+		}
+		debug.Printf("Fetched page %d with %d volumes in %s\n", page, len(resp.Volumes), i.region)
+
+		for _, v := range resp.Volumes {
+			vol := &EBSVolume{Volume: v, api: i.api, region: i.region}
+
+			if i.listed != nil {
+				i.listed(vol)
+			}
+
+			if i.filter != nil {
+				included, reason := i.filter.includes(vol)
+				if !included {
+					log.Printf("Excluding volume %s in %s (%s)\n", *v.VolumeId, i.region, reason)
+					if i.excluded != nil {
+						i.excluded(vol, reason)
+					}
+					continue
+				}
+				log.Printf("Including volume %s in %s (%s)\n", *v.VolumeId, i.region, reason)
+			}
+
+			if err := fn(vol); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
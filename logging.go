@@ -9,6 +9,11 @@ import (
 func (cfg *Config) setupLogging() {
 
 	cfg.LogFile = os.Stdout
+
+	// keeping stdout for the report, so that it can be piped to other tools
+	if cfg.ReportFile == "-" {
+		cfg.LogFile = os.Stderr
+	}
 	cfg.LogFlag = log.Ldate | log.Ltime | log.Lshortfile
 
 	log.SetOutput(cfg.LogFile)
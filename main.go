@@ -21,16 +21,29 @@ var ExpirationDate = "01-Jan-2100"
 
 var eo *EBSOptimizer
 
-var debug *log.Logger
+// debug discards the debug logs until setupLogging enables them
+var debug = log.New(ioutil.Discard, "", 0)
 
 // EBSOptimizer provides the global configuration
 type EBSOptimizer struct {
 	config      *Config
 	mainEC2Conn *ec2.Client
+	filter      *volumeFilter
 }
 
 func main() {
 
+	conf = Config{Version: Version}
+	conf.ParseCommandlineFlags()
+	// after parsing the flags, which may redirect the logs to stderr
+	conf.setupLogging()
+	log.Println("Determined configuration")
+
+	// initialized once, also on Lambda where the handler then runs for every
+	// event
+	eo = &EBSOptimizer{}
+	eo.Init(&conf)
+
 	eventFile := conf.EventFile
 
 	if runningFromLambda() {
@@ -40,43 +53,44 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		Handler(context.TODO(), parseEvent)
+		if report, _ := Handler(context.TODO(), parseEvent); report != nil && report.err() != nil {
+			os.Exit(1)
+		}
 	} else {
-		eventHandler(nil)
+		if report := eventHandler(nil); report != nil && report.err() != nil {
+			os.Exit(1)
+		}
 	}
 }
 
-func eventHandler(event *json.RawMessage) {
+func eventHandler(event *json.RawMessage) *runReport {
 
 	log.Println("Starting ebs-optimizer, build ", Version)
 
 	if isExpired(ExpirationDate) {
 		log.Println("EBS-Optimizer expired, please install a newer version.")
-		return
+		return nil
 	}
 
 	log.Printf("Configuration flags: %#v", conf)
 
-	eo.run(event)
-	log.Println("Execution completed, nothing left to do")
-}
-
-// this is the equivalent of a main for when running from Lambda, but on Lambda
-// the runFromCronEvent() is executed within the handler function every time we have an event
-func init() {
-	conf = Config{Version: Version}
-	conf.setupLogging()
-	log.Println("Determining configuration")
-	conf.ParseCommandlineFlags()
+	report := eo.run(event)
+	report.finish()
+	report.logRecap()
 
-	eo = &EBSOptimizer{}
+	if err := report.write(conf.ReportFile); err != nil {
+		log.Println("Couldn't write the run report:", err.Error())
+	}
 
-	eo.Init(&conf)
+	log.Println("Execution completed, nothing left to do")
+	return report
 }
 
-// Handler implements the AWS Lambda handler interface
-func Handler(ctx context.Context, rawEvent json.RawMessage) {
-	eventHandler(&rawEvent)
+// Handler implements the AWS Lambda handler interface, returning the run report.
+// The failures are recorded in the report instead of being returned as an
+// error, since Lambda drops the payload of the failed invocations.
+func Handler(ctx context.Context, rawEvent json.RawMessage) (*runReport, error) {
+	return eventHandler(&rawEvent), nil
 }
 
 func runningFromLambda() bool {
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// TestMain loads the pricing snapshot embedded in the binary, so that the
+// tests don't depend on the Pricing API.
+func TestMain(m *testing.M) {
+	var cache pricingCache
+	if err := json.Unmarshal(pricingSnapshot, &cache); err != nil {
+		panic(err)
+	}
+	cache.apply()
+	os.Exit(m.Run())
+}
+
+// withConfig runs the test with a copy of the global configuration, modified
+// by the given function and restored at the end of the test.
+func withConfig(t *testing.T, modify func(c *Config)) {
+	saved := conf
+	t.Cleanup(func() { conf = saved })
+	modify(&conf)
+}
+
+// testVolume returns a volume in us-east-1 with the given configuration.
+func testVolume(volumeType string, size, iops, throughput int32) *EBSVolume {
+	v := &EBSVolume{
+		Volume: types.Volume{
+			VolumeId:         aws.String("vol-0123456789abcdef0"),
+			VolumeType:       types.VolumeType(volumeType),
+			Size:             aws.Int32(size),
+			AvailabilityZone: aws.String("us-east-1a"),
+		},
+		region: "us-east-1",
+		api:    ec2Conn{region: "us-east-1", instanceCache: newInstanceCache()},
+	}
+	if iops > 0 {
+		v.Iops = aws.Int32(iops)
+	}
+	if throughput > 0 {
+		v.Throughput = aws.Int32(throughput)
+	}
+	return v
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// metricsMinDatapoints is the minimum number of periods with activity data
+// needed for sizing a volume based on its metrics.
+const metricsMinDatapoints = 12
+
+// cloudWatchAPI is the part of the CloudWatch client used for reading the
+// volume metrics, which can be replaced with a fake.
+type cloudWatchAPI interface {
+	GetMetricData(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error)
+}
+
+// volumeUsage is the performance a volume needs according to its metrics,
+// computed as a percentile of the per-period usage plus some headroom.
+type volumeUsage struct {
+	IOPS       int32 `json:"iops"`
+	Throughput int32 `json:"throughput"`
+	Datapoints int   `json:"datapoints"`
+
+	// the highest per-period usage, without headroom
+	PeakIOPS       int32 `json:"peakIops"`
+	PeakThroughput int32 `json:"peakThroughput"`
+
+	// the lowest BurstBalance percentage, only reported for burstable volumes
+	MinBurstBalance *float64 `json:"minBurstBalance,omitempty"`
+}
+
+// metricsPeriod picks the finest period for which CloudWatch still retains
+// the data over the whole lookback, and at which all volume types publish
+// their metrics.
+func metricsPeriod(lookback time.Duration) int32 {
+	if lookback <= 63*24*time.Hour {
+		return 300
+	}
+	return 3600
+}
+
+func maxValue(values []float64) float64 {
+	var m float64
+	for _, v := range values {
+		m = math.Max(m, v)
+	}
+	return m
+}
+
+// percentile returns the nearest-rank percentile of the values.
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func volumeMetricQuery(id, volumeID, name, stat string, period int32) types.MetricDataQuery {
+	return types.MetricDataQuery{
+		Id: aws.String(id),
+		MetricStat: &types.MetricStat{
+			Metric: &types.Metric{
+				Namespace:  aws.String("AWS/EBS"),
+				MetricName: aws.String(name),
+				Dimensions: []types.Dimension{{
+					Name:  aws.String("VolumeId"),
+					Value: aws.String(volumeID),
+				}},
+			},
+			Period: aws.Int32(period),
+			Stat:   aws.String(stat),
+		},
+		ReturnData: aws.Bool(false),
+	}
+}
+
+// usage reads the IOPS and throughput of the volume over the configured
+// lookback, and derives the performance it needs. It returns nil without an
+// error when there's not enough data, such as for unattached volumes. The
+// metrics are only fetched once per volume.
+func (v *EBSVolume) usage() (*volumeUsage, error) {
+	if !v.usageRead {
+		v.usageData, v.usageErr = v.fetchUsage()
+		v.usageRead = true
+	}
+	return v.usageData, v.usageErr
+}
+
+func (v *EBSVolume) fetchUsage() (*volumeUsage, error) {
+	if v.api.cloudwatch == nil {
+		return nil, fmt.Errorf("no CloudWatch connection in %s", v.region)
+	}
+
+	period := metricsPeriod(conf.MetricsLookback)
+	end := time.Now()
+	start := end.Add(-conf.MetricsLookback)
+	id := *v.VolumeId
+
+	input := &cloudwatch.GetMetricDataInput{
+		StartTime: aws.Time(start),
+		EndTime:   aws.Time(end),
+		MetricDataQueries: []types.MetricDataQuery{
+			volumeMetricQuery("ro", id, "VolumeReadOps", "Sum", period),
+			volumeMetricQuery("wo", id, "VolumeWriteOps", "Sum", period),
+			volumeMetricQuery("rb", id, "VolumeReadBytes", "Sum", period),
+			volumeMetricQuery("wb", id, "VolumeWriteBytes", "Sum", period),
+			{
+				Id:         aws.String("iops"),
+				Expression: aws.String(fmt.Sprintf("(FILL(ro, 0) + FILL(wo, 0)) / %d", period)),
+			},
+			{
+				Id:         aws.String("throughput"),
+				Expression: aws.String(fmt.Sprintf("(FILL(rb, 0) + FILL(wb, 0)) / %d / 1048576", period)),
+			},
+		},
+	}
+
+	if v.VolumeType == "gp2" {
+		burst := volumeMetricQuery("burst", id, "BurstBalance", "Minimum", period)
+		burst.ReturnData = aws.Bool(true)
+		input.MetricDataQueries = append(input.MetricDataQueries, burst)
+	}
+
+	values := make(map[string][]float64)
+
+	paginator := cloudwatch.NewGetMetricDataPaginator(v.api.cloudwatch, input)
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp.MetricDataResults {
+			name := aws.ToString(r.Id)
+			values[name] = append(values[name], r.Values...)
+		}
+	}
+
+	datapoints := len(values["iops"])
+	if datapoints < metricsMinDatapoints {
+		debug.Printf("Only %d metric datapoints for %s in %s, not enough for sizing it\n", datapoints, id, v.region)
+		return nil, nil
+	}
+
+	headroom := 1 + conf.MetricsHeadroom/100
+	u := volumeUsage{
+		IOPS:       int32(math.Ceil(percentile(values["iops"], conf.MetricsPercentile) * headroom)),
+		Throughput: int32(math.Ceil(percentile(values["throughput"], conf.MetricsPercentile) * headroom)),
+		Datapoints: datapoints,
+
+		PeakIOPS:       int32(math.Ceil(maxValue(values["iops"]))),
+		PeakThroughput: int32(math.Ceil(maxValue(values["throughput"]))),
+	}
+	if burst := values["burst"]; len(burst) > 0 {
+		minBurst := burst[0]
+		for _, b := range burst {
+			minBurst = math.Min(minBurst, b)
+		}
+		u.MinBurstBalance = &minBurst
+	}
+	debug.Printf("Usage of %s in %s over the last %s: %+v\n", id, v.region, conf.MetricsLookback, u)
+	return &u, nil
+}
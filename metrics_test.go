@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// fakeCloudWatch returns the configured values for the queries returning
+// data, and records the last request.
+type fakeCloudWatch struct {
+	values map[string][]float64
+	err    error
+	input  *cloudwatch.GetMetricDataInput
+}
+
+func (f *fakeCloudWatch) GetMetricData(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+	f.input = params
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	var out cloudwatch.GetMetricDataOutput
+	for _, q := range params.MetricDataQueries {
+		if !aws.ToBool(q.ReturnData) && q.Expression == nil {
+			continue
+		}
+		out.MetricDataResults = append(out.MetricDataResults, types.MetricDataResult{
+			Id:     q.Id,
+			Values: f.values[aws.ToString(q.Id)],
+		})
+	}
+	return &out, nil
+}
+
+// repeat returns n copies of the value.
+func repeat(value float64, n int) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+// series returns the values from 1 to n.
+func series(n int) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = float64(i + 1)
+	}
+	return values
+}
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		p      float64
+		want   float64
+	}{
+		{"empty", nil, 99, 0},
+		{"single value", []float64{42}, 99, 42},
+		{"median", series(100), 50, 50},
+		{"99th", series(100), 99, 99},
+		{"maximum", series(100), 100, 100},
+		{"zeroth is the minimum", series(100), 0, 1},
+		{"nearest rank rounds up", series(10), 95, 10},
+		{"unsorted", []float64{5, 1, 4, 2, 3}, 60, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentile(tt.values, tt.p); got != tt.want {
+				t.Errorf("percentile(%v, %v) = %v, want %v", tt.values, tt.p, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPercentileKeepsValues(t *testing.T) {
+	values := []float64{3, 1, 2}
+	percentile(values, 50)
+	if values[0] != 3 || values[1] != 1 || values[2] != 2 {
+		t.Errorf("percentile sorted its input: %v", values)
+	}
+}
+
+func TestMetricsPeriod(t *testing.T) {
+	tests := []struct {
+		lookback time.Duration
+		want     int32
+	}{
+		{24 * time.Hour, 300},
+		{14 * 24 * time.Hour, 300},
+		{63 * 24 * time.Hour, 300},
+		{64 * 24 * time.Hour, 3600},
+		{455 * 24 * time.Hour, 3600},
+	}
+
+	for _, tt := range tests {
+		if got := metricsPeriod(tt.lookback); got != tt.want {
+			t.Errorf("metricsPeriod(%s) = %d, want %d", tt.lookback, got, tt.want)
+		}
+	}
+}
+
+func TestFetchUsageLookback(t *testing.T) {
+	tests := []struct {
+		lookback time.Duration
+		period   int32
+	}{
+		{72 * time.Hour, 300},
+		{90 * 24 * time.Hour, 3600},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lookback.String(), func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.MetricsLookback = tt.lookback
+				c.MetricsPercentile = 99
+			})
+
+			cw := &fakeCloudWatch{}
+			v := testVolume("gp2", 100, 300, 0)
+			v.api.cloudwatch = cw
+
+			if _, err := v.fetchUsage(); err != nil {
+				t.Fatal(err)
+			}
+
+			in := cw.input
+			if got := in.EndTime.Sub(*in.StartTime); got != tt.lookback {
+				t.Errorf("queried %s of metrics, want %s", got, tt.lookback)
+			}
+			if time.Since(*in.EndTime) > time.Minute {
+				t.Errorf("metrics queried until %s, want now", in.EndTime)
+			}
+
+			for _, q := range in.MetricDataQueries {
+				if q.MetricStat != nil && aws.ToInt32(q.MetricStat.Period) != tt.period {
+					t.Errorf("query %s has period %d, want %d", aws.ToString(q.Id), aws.ToInt32(q.MetricStat.Period), tt.period)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchUsage(t *testing.T) {
+	tests := []struct {
+		name       string
+		volumeType string
+		values     map[string][]float64
+		percentile float64
+		headroom   float64
+		want       *volumeUsage
+	}{
+		{
+			name:       "not enough datapoints",
+			volumeType: "gp2",
+			values:     map[string][]float64{"iops": repeat(100, metricsMinDatapoints-1), "throughput": repeat(10, metricsMinDatapoints-1)},
+			percentile: 99,
+			headroom:   20,
+		},
+		{
+			name:       "percentile with headroom",
+			volumeType: "gp3",
+			values:     map[string][]float64{"iops": series(100), "throughput": series(100)},
+			percentile: 90,
+			headroom:   50,
+			want:       &volumeUsage{IOPS: 135, Throughput: 135, Datapoints: 100, PeakIOPS: 100, PeakThroughput: 100},
+		},
+		{
+			name:       "headroom rounded up",
+			volumeType: "gp3",
+			values:     map[string][]float64{"iops": repeat(1001, 20), "throughput": repeat(0.5, 20)},
+			percentile: 99,
+			headroom:   10,
+			want:       &volumeUsage{IOPS: 1102, Throughput: 1, Datapoints: 20, PeakIOPS: 1001, PeakThroughput: 1},
+		},
+		{
+			name:       "without headroom",
+			volumeType: "gp3",
+			values:     map[string][]float64{"iops": series(12), "throughput": repeat(7, 12)},
+			percentile: 50,
+			headroom:   0,
+			want:       &volumeUsage{IOPS: 6, Throughput: 7, Datapoints: 12, PeakIOPS: 12, PeakThroughput: 7},
+		},
+		{
+			name:       "burst balance of gp2",
+			volumeType: "gp2",
+			values:     map[string][]float64{"iops": repeat(100, 12), "throughput": repeat(10, 12), "burst": {100, 42.5, 80}},
+			percentile: 99,
+			headroom:   0,
+			want:       &volumeUsage{IOPS: 100, Throughput: 10, Datapoints: 12, PeakIOPS: 100, PeakThroughput: 10, MinBurstBalance: aws.Float64(42.5)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.MetricsLookback = 14 * 24 * time.Hour
+				c.MetricsPercentile = tt.percentile
+				c.MetricsHeadroom = tt.headroom
+			})
+
+			v := testVolume(tt.volumeType, 100, 3000, 125)
+			v.api.cloudwatch = &fakeCloudWatch{values: tt.values}
+
+			got, err := v.fetchUsage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalUsage(got, tt.want) {
+				t.Errorf("fetchUsage() = %s, want %s", describeUsage(got), describeUsage(tt.want))
+			}
+		})
+	}
+}
+
+func TestFetchUsageErrors(t *testing.T) {
+	withConfig(t, func(c *Config) { c.MetricsLookback = 24 * time.Hour })
+
+	v := testVolume("gp2", 100, 300, 0)
+	if _, err := v.fetchUsage(); err == nil {
+		t.Error("expected an error without a CloudWatch connection")
+	}
+
+	v.api.cloudwatch = &fakeCloudWatch{err: errors.New("throttled")}
+	if _, err := v.fetchUsage(); err == nil {
+		t.Error("expected the CloudWatch error")
+	}
+}
+
+// TestMetricsSizing checks the gp3 configuration replacing gp2 volumes when
+// it's sized based on their metrics.
+func TestMetricsSizing(t *testing.T) {
+	tests := []struct {
+		name           string
+		size           int32
+		iops           []float64
+		throughput     []float64
+		wantIOPS       int32
+		wantThroughput int32
+	}{
+		{
+			name:           "idle volume gets the gp3 baseline",
+			size:           100,
+			iops:           repeat(10, 100),
+			throughput:     repeat(1, 100),
+			wantIOPS:       3000,
+			wantThroughput: 125,
+		},
+		{
+			name:           "busy volume above the baseline",
+			size:           1000,
+			iops:           repeat(4000, 100),
+			throughput:     repeat(200, 100),
+			wantIOPS:       4800,
+			wantThroughput: 240,
+		},
+		{
+			name:           "occasional spikes above the percentile are ignored",
+			size:           1000,
+			iops:           append(repeat(2000, 99), 15000),
+			throughput:     append(repeat(100, 99), 900),
+			wantIOPS:       3000,
+			wantThroughput: 125,
+		},
+		{
+			name:           "not enough metrics keeps the default sizing",
+			size:           2000,
+			iops:           repeat(9000, 5),
+			throughput:     repeat(500, 5),
+			wantIOPS:       3000,
+			wantThroughput: 125,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.MetricsSizing = true
+				c.MetricsLookback = 14 * 24 * time.Hour
+				c.MetricsPercentile = 99
+				c.MetricsHeadroom = 20
+			})
+
+			v := testVolume("gp2", tt.size, 3*tt.size, 0)
+			v.api.cloudwatch = &fakeCloudWatch{values: map[string][]float64{
+				"iops":       tt.iops,
+				"throughput": tt.throughput,
+			}}
+
+			d := v.decide()
+			if d.Target.VolumeType != "gp3" {
+				t.Fatalf("converted to %s, want gp3", d.Target.VolumeType)
+			}
+			if d.Target.IOPS != tt.wantIOPS || d.Target.Throughput != tt.wantThroughput {
+				t.Errorf("converted to %d IOPS and %dMiB/s, want %d IOPS and %dMiB/s",
+					d.Target.IOPS, d.Target.Throughput, tt.wantIOPS, tt.wantThroughput)
+			}
+		})
+	}
+}
+
+func equalUsage(a, b *volumeUsage) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if (a.MinBurstBalance == nil) != (b.MinBurstBalance == nil) {
+		return false
+	}
+	if a.MinBurstBalance != nil && math.Abs(*a.MinBurstBalance-*b.MinBurstBalance) > 1e-9 {
+		return false
+	}
+	return a.IOPS == b.IOPS && a.Throughput == b.Throughput && a.Datapoints == b.Datapoints &&
+		a.PeakIOPS == b.PeakIOPS && a.PeakThroughput == b.PeakThroughput
+}
+
+func describeUsage(u *volumeUsage) string {
+	if u == nil {
+		return "nil"
+	}
+	burst := "none"
+	if u.MinBurstBalance != nil {
+		burst = fmt.Sprint(*u.MinBurstBalance)
+	}
+	return fmt.Sprintf("%+v with minimum burst balance %s", *u, burst)
+}
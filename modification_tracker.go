@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// modificationPollInterval is the time between two checks of the state of the
+// volume modifications, multiplied by Config.SleepMultiplier.
+const modificationPollInterval = 15 * time.Second
+
+// modificationReport is the last known state of the modification of a volume.
+type modificationReport struct {
+	State         string     `json:"state"`
+	Progress      int64      `json:"progress"`
+	StatusMessage string     `json:"statusMessage,omitempty"`
+	StartTime     *time.Time `json:"startTime,omitempty"`
+	EndTime       *time.Time `json:"endTime,omitempty"`
+
+	// time elapsed from the start of the modification until its last known state
+	DurationSeconds float64 `json:"durationSeconds"`
+
+	// set when tracking gave up before the modification took effect
+	TimedOut bool `json:"timedOut,omitempty"`
+
+	// set when the volume was restored to its previous configuration after
+	// the modification failed
+	RolledBack bool `json:"rolledBack,omitempty"`
+}
+
+type trackedModification struct {
+	volume *EBSVolume
+	report *volumeReport
+}
+
+// modificationTracker polls the state of the volume modifications started in
+// a region, until they take effect or fail.
+type modificationTracker struct {
+	api    ec2Conn
+	region string
+
+	timeout           time.Duration
+	rollbackOnFailure bool
+
+	pending map[string]*trackedModification
+}
+
+// track adds the volume to the modification tracker of the region, if it was
+// actually modified.
+func (r *region) track(v *EBSVolume, vr *volumeReport) {
+	if vr.Action != ActionModified || r.conf.ModificationTimeout <= 0 {
+		return
+	}
+	if r.tracker == nil {
+		r.tracker = &modificationTracker{
+			api:     r.api,
+			region:  r.name,
+			timeout: r.conf.ModificationTimeout,
+			// a failed rollback shouldn't trigger yet another rollback
+			rollbackOnFailure: r.conf.RollbackOnFailure && r.conf.Mode != ModeRollback,
+			pending:           make(map[string]*trackedModification),
+		}
+	}
+	r.tracker.pending[*v.VolumeId] = &trackedModification{volume: v, report: vr}
+}
+
+// waitForModifications waits for the modifications tracked in the region and
+// updates the region totals with their outcome.
+func (r *region) waitForModifications() {
+	if r.tracker == nil {
+		return
+	}
+	r.tracker.wait()
+	r.report.recomputeTotals()
+}
+
+// wait polls the modifications until none of them is still in the modifying
+// state, or until the timeout expires. Modifications in the optimizing state
+// are considered done, since the new configuration is already in effect.
+func (t *modificationTracker) wait() {
+
+	log.Printf("Tracking %d volume modifications in %s\n", len(t.pending), t.region)
+
+	maxPolls := int(t.timeout / modificationPollInterval)
+
+	for poll := 0; len(t.pending) > 0; poll++ {
+		if poll > 0 {
+			if poll > maxPolls {
+				break
+			}
+			time.Sleep(modificationPollInterval * conf.SleepMultiplier)
+		}
+
+		modifications, err := t.describe()
+		if err != nil {
+			log.Printf("Couldn't describe the volume modifications in %s: %s\n", t.region, err.Error())
+			continue
+		}
+
+		for _, m := range modifications {
+			t.update(m)
+		}
+	}
+
+	for id, tm := range t.pending {
+		log.Printf("Volume %s in %s is still being modified after %s, giving up tracking it\n", id, t.region, t.timeout)
+		if tm.report.Modification == nil {
+			tm.report.Modification = &modificationReport{State: string(types.VolumeModificationStateModifying)}
+		}
+		tm.report.Modification.TimedOut = true
+	}
+}
+
+// describe fetches the state of the pending modifications.
+func (t *modificationTracker) describe() ([]types.VolumeModification, error) {
+	var ids []string
+	var modifications []types.VolumeModification
+
+	for id := range t.pending {
+		ids = append(ids, id)
+	}
+
+	for start := 0; start < len(ids); start += volumeIDsPerFilter {
+		end := start + volumeIDsPerFilter
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk := ids[start:end]
+
+		paginator := ec2.NewDescribeVolumesModificationsPaginator(t.api.ec2, &ec2.DescribeVolumesModificationsInput{
+			Filters: []types.Filter{{
+				Name:   aws.String("volume-id"),
+				Values: chunk,
+			}},
+		})
+
+		for paginator.HasMorePages() {
+			resp, err := paginator.NextPage(context.TODO())
+			if err != nil {
+				return nil, err
+			}
+			modifications = append(modifications, resp.VolumesModifications...)
+		}
+	}
+	return modifications, nil
+}
+
+// update records the state of a modification in the volume report, and stops
+// tracking it once it took effect or failed.
+func (t *modificationTracker) update(m types.VolumeModification) {
+	id := aws.ToString(m.VolumeId)
+	tm, found := t.pending[id]
+	if !found {
+		return
+	}
+
+	mr := &modificationReport{
+		State:         string(m.ModificationState),
+		Progress:      aws.ToInt64(m.Progress),
+		StatusMessage: aws.ToString(m.StatusMessage),
+		StartTime:     m.StartTime,
+		EndTime:       m.EndTime,
+	}
+	if m.StartTime != nil {
+		end := time.Now()
+		if m.EndTime != nil {
+			end = *m.EndTime
+		}
+		mr.DurationSeconds = end.Sub(*m.StartTime).Seconds()
+	}
+	tm.report.Modification = mr
+
+	debug.Printf("Modification of volume %s in %s is %s, %d%% done\n", id, t.region, mr.State, mr.Progress)
+
+	switch m.ModificationState {
+	case types.VolumeModificationStateOptimizing, types.VolumeModificationStateCompleted:
+		log.Printf("Modification of volume %s in %s took effect after %.0fs, now %s\n",
+			id, t.region, mr.DurationSeconds, mr.State)
+		delete(t.pending, id)
+
+	case types.VolumeModificationStateFailed:
+		log.Printf("Modification of volume %s in %s failed: %s\n", id, t.region, mr.StatusMessage)
+		tm.report.fail(fmt.Errorf("volume modification failed: %s", mr.StatusMessage))
+		if t.rollbackOnFailure {
+			if err := tm.volume.restorePreviousConfiguration(); err != nil {
+				log.Printf("Couldn't roll back volume %s in %s: %s\n", id, t.region, err.Error())
+				tm.report.Error += fmt.Sprintf(", rollback failed: %s", err.Error())
+			} else {
+				mr.RolledBack = true
+			}
+		}
+		delete(t.pending, id)
+	}
+}
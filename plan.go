@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// planVersion is increased on incompatible changes of the plan file format.
+const planVersion = 1
+
+// plan is the list of conversions computed in plan mode, which is reviewed and
+// then executed as-is in apply mode.
+type plan struct {
+	Version     int             `json:"version"`
+	RunID       string          `json:"runId"`
+	ToolVersion string          `json:"toolVersion"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	Volumes     []plannedVolume `json:"volumes"`
+
+	TotalEstimatedMonthlySavings float64 `json:"totalEstimatedMonthlySavings"`
+}
+
+type plannedVolume struct {
+	VolumeID string `json:"volumeId"`
+	Region   string `json:"region"`
+
+	// the configuration the volume is expected to have when applying the plan
+	Current volumeConfig `json:"current"`
+	Target  volumeConfig `json:"target"`
+
+	MonthlyCostBefore       float64 `json:"monthlyCostBefore"`
+	MonthlyCostAfter        float64 `json:"monthlyCostAfter"`
+	EstimatedMonthlySavings float64 `json:"estimatedMonthlySavings"`
+}
+
+// newPlan collects the planned conversions from the report of a plan run.
+func newPlan(r *runReport) *plan {
+	p := &plan{
+		Version:     planVersion,
+		RunID:       r.RunID,
+		ToolVersion: r.Version,
+		CreatedAt:   r.StartedAt,
+		Volumes:     []plannedVolume{},
+	}
+
+	for _, rr := range r.Regions {
+		for _, vr := range rr.Volumes {
+			if vr.Action != ActionPlanned || vr.Target == nil {
+				continue
+			}
+			pv := plannedVolume{
+				VolumeID:                vr.VolumeID,
+				Region:                  rr.Region,
+				Current:                 *vr.Current,
+				Target:                  *vr.Target,
+				MonthlyCostBefore:       vr.MonthlyCostBefore,
+				MonthlyCostAfter:        vr.MonthlyCostAfter,
+				EstimatedMonthlySavings: vr.MonthlyCostBefore - vr.MonthlyCostAfter,
+			}
+			p.Volumes = append(p.Volumes, pv)
+			p.TotalEstimatedMonthlySavings += pv.EstimatedMonthlySavings
+		}
+	}
+
+	sort.Slice(p.Volumes, func(i, j int) bool {
+		if p.Volumes[i].Region != p.Volumes[j].Region {
+			return p.Volumes[i].Region < p.Volumes[j].Region
+		}
+		return p.Volumes[i].VolumeID < p.Volumes[j].VolumeID
+	})
+	return p
+}
+
+func (p *plan) write(path string) error {
+	if path == "" {
+		return fmt.Errorf("no plan file configured")
+	}
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Writing the plan with %d volume conversions, saving $%.2f/month, to %s\n",
+		len(p.Volumes), p.TotalEstimatedMonthlySavings, path)
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func readPlan(path string) (*plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p plan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid plan file %s: %w", path, err)
+	}
+
+	if p.Version != planVersion {
+		return nil, fmt.Errorf("unsupported plan file version %d, expected %d", p.Version, planVersion)
+	}
+	return &p, nil
+}
+
+// byRegion groups the planned volumes by region.
+func (p *plan) byRegion() map[string][]plannedVolume {
+	regions := make(map[string][]plannedVolume)
+	for _, pv := range p.Volumes {
+		regions[pv.Region] = append(regions[pv.Region], pv)
+	}
+	return regions
+}
+
+// applyPlan executes the conversions from the plan file, in parallel for all
+// regions. Only the volumes whose live configuration still matches the one
+// recorded in the plan are modified, the others are reported as failed.
+func (e *EBSOptimizer) applyPlan(report *runReport) {
+
+	p, err := readPlan(e.config.PlanFile)
+	if err != nil {
+		log.Println("Couldn't read the plan:", err.Error())
+		report.addError("couldn't read the plan: %s", err.Error())
+		return
+	}
+
+	log.Printf("Applying plan %s created at %s with %d volume conversions\n",
+		p.RunID, p.CreatedAt.Format(time.RFC3339), len(p.Volumes))
+
+	var wg sync.WaitGroup
+
+	for reg, volumes := range p.byRegion() {
+
+		wg.Add(1)
+
+		r := region{name: reg, conf: e.config, report: &regionReport{Region: reg, Enabled: true}}
+		planned := volumes
+
+		go func() {
+			defer wg.Done()
+
+			r.api.connect(r.name, r.conf.MainRegion)
+			if err := r.applyPlannedVolumes(planned); err != nil {
+				log.Printf("Failed applying the plan in %s: %s", r.name, err.Error())
+				r.report.Error = err.Error()
+			}
+			report.addRegion(r.report)
+		}()
+	}
+	wg.Wait()
+}
+
+// applyPlannedVolumes fetches the live state of the planned volumes of the
+// region and converts those still matching the plan.
+func (r *region) applyPlannedVolumes(planned []plannedVolume) error {
+
+	remaining := make(map[string]plannedVolume)
+	for _, pv := range planned {
+		remaining[pv.VolumeID] = pv
+	}
+
+	var ids []string
+	for _, pv := range planned {
+		ids = append(ids, pv.VolumeID)
+	}
+
+	inv := &inventory{api: r.api, region: r.name, volumeIDs: ids}
+
+	err := inv.forEach(func(v *EBSVolume) error {
+		pv, found := remaining[*v.VolumeId]
+		if !found {
+			return nil
+		}
+		delete(remaining, *v.VolumeId)
+
+		vr := v.applyPlanned(&pv)
+		r.report.addVolume(vr)
+		r.track(v, vr)
+		if vr.failed() {
+			log.Println("Could not convert volume", *v.VolumeId, vr.Error)
+		}
+		return nil
+	})
+	r.waitForModifications()
+	if err != nil {
+		return err
+	}
+
+	for _, pv := range planned {
+		if _, missing := remaining[pv.VolumeID]; !missing {
+			continue
+		}
+		current := pv.Current
+		vr := &volumeReport{
+			VolumeID:          pv.VolumeID,
+			Current:           &current,
+			MonthlyCostBefore: pv.MonthlyCostBefore,
+		}
+		vr.fail(fmt.Errorf("volume %s no longer exists", pv.VolumeID))
+		log.Println("Could not convert volume", pv.VolumeID, vr.Error)
+		r.report.addVolume(vr)
+	}
+	return nil
+}
+
+// applyPlanned converts the volume to the planned target configuration, unless
+// its live configuration changed since the plan was created.
+func (v *EBSVolume) applyPlanned(pv *plannedVolume) *volumeReport {
+
+	log.Printf("Applying the planned conversion of volume %s in %s\n", *v.VolumeId, v.region)
+	vr := newVolumeReport(v)
+
+	if live := v.getCurrentConfiguration(); *live != pv.Current {
+		log.Printf("Live configuration of volume %s in %s is %+v, planned from %+v\n",
+			*v.VolumeId, v.region, *live, pv.Current)
+		vr.fail(fmt.Errorf("live configuration %s no longer matches the planned one %s",
+			live.toString(), pv.Current.toString()))
+		return vr
+	}
+
+	if !v.checkOverrides(vr) {
+		return vr
+	}
+
+	if reason := v.incompatibility(string(pv.Target.VolumeType)); reason != "" {
+		log.Printf("Volume %s in %s can't be converted to %s: %s\n", *v.VolumeId, v.region, pv.Target.VolumeType, reason)
+		vr.ineligible(reason)
+		return vr
+	}
+
+	vr.setTarget(&pv.Target)
+	eligibleAt, reason, err := v.eligibility()
+	if err != nil {
+		log.Printf("Couldn't schedule the modification of volume %s in %s: %s\n", *v.VolumeId, v.region, err.Error())
+		vr.needsReview(err.Error())
+		return vr
+	}
+	if eligibleAt.After(time.Now()) {
+		log.Printf("Volume %s in %s can't be modified yet, deferring it until %s\n",
+			*v.VolumeId, v.region, eligibleAt.Format(time.RFC3339))
+		vr.deferUntil(eligibleAt, reason+", apply the plan again later")
+		return vr
+	}
+	if err := v.modify(&pv.Target); err != nil {
+		vr.fail(err)
+		return vr
+	}
+	vr.applied(fmt.Sprintf("converted according to the plan, saving $%.2f/month",
+		vr.MonthlyCostBefore-vr.MonthlyCostAfter))
+	return vr
+}
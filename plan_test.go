@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+func TestNewPlan(t *testing.T) {
+	gp2 := &volumeConfig{VolumeType: "gp2", Region: "us-east-1", Size: 100, IOPS: 300}
+	gp3 := &volumeConfig{VolumeType: "gp3", Region: "us-east-1", Size: 100, IOPS: 3000, Throughput: 125}
+
+	planned := func(id string, before, after float64) *volumeReport {
+		return &volumeReport{VolumeID: id, Current: gp2, Target: gp3, MonthlyCostBefore: before, MonthlyCostAfter: after, Action: ActionPlanned}
+	}
+
+	r := &runReport{
+		RunID:     "run-1",
+		Version:   "v1",
+		StartedAt: time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC),
+		Regions: []*regionReport{
+			{Region: "us-west-2", Volumes: []*volumeReport{planned("vol-c", 10, 8)}},
+			{Region: "eu-west-1", Volumes: []*volumeReport{
+				planned("vol-b", 20, 16),
+				planned("vol-a", 10, 8),
+				{VolumeID: "vol-skipped", Current: gp2, Action: ActionSkipped},
+				{VolumeID: "vol-review", Current: gp2, Target: gp3, Action: ActionNeedsReview},
+				{VolumeID: "vol-no-target", Current: gp2, Action: ActionPlanned},
+			}},
+		},
+	}
+
+	p := newPlan(r)
+
+	if p.Version != planVersion || p.RunID != "run-1" || p.ToolVersion != "v1" || !p.CreatedAt.Equal(r.StartedAt) {
+		t.Errorf("plan header %+v", p)
+	}
+	var got []string
+	for _, pv := range p.Volumes {
+		got = append(got, pv.Region+"/"+pv.VolumeID)
+	}
+	if want := "eu-west-1/vol-a,eu-west-1/vol-b,us-west-2/vol-c"; strings.Join(got, ",") != want {
+		t.Errorf("planned volumes %s, want %s", strings.Join(got, ","), want)
+	}
+	if p.Volumes[1].EstimatedMonthlySavings != 4 || p.TotalEstimatedMonthlySavings != 8 {
+		t.Errorf("savings %v of vol-b and %v in total, want 4 and 8", p.Volumes[1].EstimatedMonthlySavings, p.TotalEstimatedMonthlySavings)
+	}
+}
+
+func TestReadPlan(t *testing.T) {
+	dir := t.TempDir()
+
+	p := newPlan(&runReport{RunID: "run-1", Regions: []*regionReport{{Region: "us-east-1", Volumes: []*volumeReport{{
+		VolumeID: "vol-a",
+		Current:  &volumeConfig{VolumeType: "gp2", Region: "us-east-1", Size: 100, IOPS: 300},
+		Target:   &volumeConfig{VolumeType: "gp3", Region: "us-east-1", Size: 100, IOPS: 3000, Throughput: 125},
+		Action:   ActionPlanned,
+	}}}}})
+
+	path := filepath.Join(dir, "plan.json")
+	if err := p.write(path); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readPlan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.RunID != "run-1" || len(read.Volumes) != 1 || read.Volumes[0].Target != p.Volumes[0].Target {
+		t.Errorf("read the plan %+v, want %+v", read, p)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"other version", `{"version": 2, "volumes": []}`, "unsupported plan file version 2"},
+		{"missing version", `{"volumes": []}`, "unsupported plan file version 0"},
+		{"invalid JSON", `{"version": 1,`, "invalid plan file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Replace(tt.name, " ", "-", -1)+".json")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readPlan(path); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected an error about %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	if _, err := readPlan(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("read a missing plan file")
+	}
+}
+
+func TestApplyPlannedStale(t *testing.T) {
+	v := testVolume("gp2", 200, 600, 0)
+	pv := plannedVolume{
+		VolumeID: *v.VolumeId,
+		Region:   "us-east-1",
+		Current:  volumeConfig{VolumeType: "gp2", Region: "us-east-1", Size: 100, IOPS: 300},
+		Target:   volumeConfig{VolumeType: "gp3", Region: "us-east-1", Size: 100, IOPS: 3000, Throughput: 125},
+	}
+
+	vr := v.applyPlanned(&pv)
+	if !vr.failed() || !strings.Contains(vr.Error, "no longer matches the planned one") {
+		t.Errorf("action %s with error %q, want a failure about the stale plan", vr.Action, vr.Error)
+	}
+	if vr.Target != nil {
+		t.Errorf("reported the target %+v of a stale plan", vr.Target)
+	}
+}
+
+// fakeEC2 serves the DescribeVolumes calls with the given volumes, recording
+// the requested volume IDs.
+func fakeEC2(t *testing.T, volumes string, requested *[]string) *ec2.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		if action := r.Form.Get("Action"); action != "DescribeVolumes" {
+			t.Errorf("unexpected %s call", action)
+			http.Error(w, "unexpected call", http.StatusBadRequest)
+			return
+		}
+		for key, values := range r.Form {
+			if strings.HasPrefix(key, "Filter.1.Value.") {
+				*requested = append(*requested, values...)
+			}
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<DescribeVolumesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><volumeSet>%s</volumeSet></DescribeVolumesResponse>`, volumes)
+	}))
+	t.Cleanup(srv.Close)
+
+	return ec2.New(ec2.Options{
+		Region:           "us-east-1",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: ec2.EndpointResolverFromURL(srv.URL),
+	})
+}
+
+func TestApplyPlannedVolumes(t *testing.T) {
+	var requested []string
+	client := fakeEC2(t, `<item><volumeId>vol-stale</volumeId><size>200</size><volumeType>gp2</volumeType><iops>600</iops></item>`, &requested)
+
+	gp2 := volumeConfig{VolumeType: "gp2", Region: "us-east-1", Size: 100, IOPS: 300}
+	gp3 := volumeConfig{VolumeType: "gp3", Region: "us-east-1", Size: 100, IOPS: 3000, Throughput: 125}
+	planned := []plannedVolume{
+		{VolumeID: "vol-stale", Region: "us-east-1", Current: gp2, Target: gp3, MonthlyCostBefore: 10},
+		{VolumeID: "vol-deleted", Region: "us-east-1", Current: gp2, Target: gp3, MonthlyCostBefore: 10},
+	}
+
+	r := &region{
+		name:   "us-east-1",
+		conf:   &Config{},
+		api:    ec2Conn{region: "us-east-1", ec2: client, instanceCache: newInstanceCache()},
+		report: &regionReport{Region: "us-east-1"},
+	}
+	if err := r.applyPlannedVolumes(planned); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(requested)
+	if strings.Join(requested, ",") != "vol-deleted,vol-stale" {
+		t.Errorf("requested the volumes %v", requested)
+	}
+	if len(r.report.Volumes) != 2 || r.report.Totals.Failed != 2 {
+		t.Fatalf("reported %d volumes with %d failures, want 2 failures", len(r.report.Volumes), r.report.Totals.Failed)
+	}
+	errors := make(map[string]string)
+	for _, vr := range r.report.Volumes {
+		errors[vr.VolumeID] = vr.Error
+	}
+	if !strings.Contains(errors["vol-stale"], "no longer matches the planned one") {
+		t.Errorf("vol-stale error %q, want a stale plan", errors["vol-stale"])
+	}
+	if errors["vol-deleted"] != "volume vol-deleted no longer exists" {
+		t.Errorf("vol-deleted error %q, want a missing volume", errors["vol-deleted"])
+	}
+}
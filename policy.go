@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/ghodss/yaml"
+)
+
+// policyVersion is increased on incompatible changes of the policy file format.
+const policyVersion = 1
+
+// conversionPolicy is the content of the policy file, an ordered list of rules
+// of which the first one matching a volume decides how it's converted. The
+// volumes not matched by any rule are converted as configured by the flags.
+type conversionPolicy struct {
+	Version int          `json:"version"`
+	Rules   []policyRule `json:"rules"`
+}
+
+type policyRule struct {
+	Name   string       `json:"name"`
+	Match  policyMatch  `json:"match"`
+	Action policyAction `json:"action"`
+
+	// compiled when loading the policy
+	regions      []*regexp.Regexp
+	tags         []tagExpression
+	instanceTags []tagExpression
+	iops         *formula
+	throughput   *formula
+}
+
+// policyMatch lists the conditions a volume needs to meet for the rule to
+// match. All the given conditions need to be met, and the conditions taking
+// a list match if any of the regions or volume types match, or if all the tag
+// expressions match. The instance tags are matched against the instances the
+// volume is attached to.
+type policyMatch struct {
+	Regions      []string     `json:"regions,omitempty"`
+	Tags         []string     `json:"tags,omitempty"`
+	VolumeTypes  []string     `json:"volumeTypes,omitempty"`
+	Size         *policyRange `json:"size,omitempty"`
+	IOPS         *policyRange `json:"iops,omitempty"`
+	InstanceTags []string     `json:"instanceTags,omitempty"`
+}
+
+// policyRange is an inclusive range, where either end may be omitted.
+type policyRange struct {
+	Min *int32 `json:"min,omitempty"`
+	Max *int32 `json:"max,omitempty"`
+}
+
+// policyAction is what happens to the volumes matched by a rule. They're
+// either skipped, or converted to the cheapest configuration of the target
+// type, if given, providing the IOPS and throughput computed by the formulas.
+type policyAction struct {
+	Skip       bool   `json:"skip,omitempty"`
+	TargetType string `json:"targetType,omitempty"`
+	IOPS       string `json:"iops,omitempty"`
+	Throughput string `json:"throughput,omitempty"`
+}
+
+// policyReport records the rule applied to a volume and its outcome.
+type policyReport struct {
+	Rule       string `json:"rule"`
+	Skip       bool   `json:"skip,omitempty"`
+	TargetType string `json:"targetType,omitempty"`
+	IOPS       *int32 `json:"iops,omitempty"`
+	Throughput *int32 `json:"throughput,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// tagExpression matches the tags of a resource, given as 'key=glob' and
+// 'key!=glob' for comparing the value, 'key' for requiring the tag and '!key'
+// for requiring its absence.
+type tagExpression struct {
+	key     string
+	negated bool
+	re      *regexp.Regexp
+}
+
+// policy is the loaded policy file, or nil if none is configured.
+var policy *conversionPolicy
+
+func parseTagExpression(text string) (tagExpression, error) {
+	var te tagExpression
+	s := strings.TrimSpace(text)
+
+	pattern := ""
+	switch {
+	case strings.Contains(s, "!="):
+		kv := strings.SplitN(s, "!=", 2)
+		te.key, pattern, te.negated = kv[0], kv[1], true
+	case strings.Contains(s, "="):
+		kv := strings.SplitN(s, "=", 2)
+		te.key, pattern = kv[0], kv[1]
+	case strings.HasPrefix(s, "!"):
+		te.key, te.negated = s[1:], true
+	default:
+		te.key = s
+	}
+
+	te.key = strings.TrimSpace(te.key)
+	if te.key == "" {
+		return te, fmt.Errorf("invalid tag expression %q: missing tag key", text)
+	}
+	if strings.Contains(s, "=") {
+		re, err := globToRegexp(strings.TrimSpace(pattern))
+		if err != nil {
+			return te, fmt.Errorf("invalid tag expression %q: %v", text, err)
+		}
+		te.re = re
+	}
+	return te, nil
+}
+
+func (te *tagExpression) matches(tags []types.Tag) bool {
+	value, found := tagValue(tags, te.key)
+	if te.re == nil {
+		return found != te.negated
+	}
+	return found && te.re.MatchString(value) != te.negated
+}
+
+func (pr *policyRange) contains(n int32) bool {
+	return (pr.Min == nil || n >= *pr.Min) && (pr.Max == nil || n <= *pr.Max)
+}
+
+func (pr *policyRange) validate() error {
+	if pr.Min != nil && pr.Max != nil && *pr.Min > *pr.Max {
+		return fmt.Errorf("min %d above max %d", *pr.Min, *pr.Max)
+	}
+	return nil
+}
+
+// parsePolicy decodes the policy file content, either JSON or YAML, and
+// compiles its rules. It returns all the problems found, so that they can be
+// fixed at once.
+func parsePolicy(data []byte) (*conversionPolicy, []string) {
+	var p conversionPolicy
+
+	// JSON is also valid YAML, so both are converted to JSON, still decoded
+	// strictly for catching the misspelled fields
+	data, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, []string{err.Error()}
+	}
+
+	problems := p.compile()
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return &p, nil
+}
+
+// compile checks the rules and prepares their patterns and formulas.
+func (p *conversionPolicy) compile() []string {
+	var problems []string
+
+	if p.Version != policyVersion {
+		problems = append(problems, fmt.Sprintf("unsupported policy version %d, expected %d", p.Version, policyVersion))
+	}
+	if len(p.Rules) == 0 {
+		problems = append(problems, "no rules")
+	}
+
+	names := make(map[string]bool)
+
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		problem := func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Sprintf("rule %d %q: ", i+1, r.Name)+fmt.Sprintf(format, args...))
+		}
+
+		if r.Name == "" {
+			problem("missing name")
+		} else if names[r.Name] {
+			problem("duplicate name")
+		}
+		names[r.Name] = true
+
+		for _, glob := range r.Match.Regions {
+			re, err := globToRegexp(glob)
+			if err != nil {
+				problem("invalid region pattern %q: %v", glob, err)
+				continue
+			}
+			r.regions = append(r.regions, re)
+		}
+		for _, text := range r.Match.Tags {
+			te, err := parseTagExpression(text)
+			if err != nil {
+				problem("%v", err)
+				continue
+			}
+			r.tags = append(r.tags, te)
+		}
+		for _, text := range r.Match.InstanceTags {
+			te, err := parseTagExpression(text)
+			if err != nil {
+				problem("instance tags: %v", err)
+				continue
+			}
+			r.instanceTags = append(r.instanceTags, te)
+		}
+		for _, vt := range r.Match.VolumeTypes {
+			if _, found := ebsInfo[vt]; !found {
+				problem("unknown volume type %q", vt)
+			}
+		}
+		if r.Match.Size != nil {
+			if err := r.Match.Size.validate(); err != nil {
+				problem("invalid size range: %v", err)
+			}
+		}
+		if r.Match.IOPS != nil {
+			if err := r.Match.IOPS.validate(); err != nil {
+				problem("invalid IOPS range: %v", err)
+			}
+		}
+
+		a := r.Action
+		if a.Skip && (a.TargetType != "" || a.IOPS != "" || a.Throughput != "") {
+			problem("the skip action can't be combined with other actions")
+		}
+		if !a.Skip && a.TargetType == "" && a.IOPS == "" && a.Throughput == "" {
+			problem("missing action")
+		}
+		if a.TargetType != "" {
+			if vi, found := ebsInfo[a.TargetType]; !found {
+				problem("unknown target volume type %q", a.TargetType)
+			} else if vi.previousGeneration {
+				problem("previous generation target volume type %q", a.TargetType)
+			}
+		}
+		if a.IOPS != "" {
+			f, err := parseFormula(a.IOPS)
+			if err != nil {
+				problem("%v", err)
+			}
+			r.iops = f
+		}
+		if a.Throughput != "" {
+			f, err := parseFormula(a.Throughput)
+			if err != nil {
+				problem("%v", err)
+			}
+			r.throughput = f
+		}
+	}
+	return problems
+}
+
+// loadPolicy reads the policy file, if configured.
+func loadPolicy(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	p, problems := parsePolicy(data)
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid policy file %s: %s", path, strings.Join(problems, "; "))
+	}
+
+	log.Printf("Loaded %d policy rules from %s\n", len(p.Rules), path)
+	policy = p
+	return nil
+}
+
+// matches checks if the rule matches the volume, looking up the instances the
+// volume is attached to when the rule has instance tag conditions.
+func (r *policyRule) matches(v *EBSVolume) (bool, error) {
+	m := r.Match
+
+	if len(r.regions) > 0 {
+		found := false
+		for _, re := range r.regions {
+			found = found || re.MatchString(v.region)
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	if len(m.VolumeTypes) > 0 {
+		found := false
+		for _, vt := range m.VolumeTypes {
+			found = found || types.VolumeType(vt) == v.VolumeType
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	for i := range r.tags {
+		if !r.tags[i].matches(v.Tags) {
+			return false, nil
+		}
+	}
+	if m.Size != nil && !m.Size.contains(aws.ToInt32(v.Size)) {
+		return false, nil
+	}
+	if m.IOPS != nil && !m.IOPS.contains(v.getIOPS()) {
+		return false, nil
+	}
+
+	if len(r.instanceTags) == 0 {
+		return true, nil
+	}
+	for _, a := range v.Attachments {
+		i, err := v.api.instance(aws.ToString(a.InstanceId))
+		if err != nil {
+			return false, fmt.Errorf("couldn't look up instance %s: %w", aws.ToString(a.InstanceId), err)
+		}
+		matched := true
+		for j := range r.instanceTags {
+			matched = matched && r.instanceTags[j].matches(i.Tags)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// policyRule returns the first rule of the policy matching the volume, or nil
+// if there's no policy or no rule matches.
+func (v *EBSVolume) policyRule() (*policyRule, error) {
+	if policy == nil {
+		return nil, nil
+	}
+	for i := range policy.Rules {
+		r := &policy.Rules[i]
+		matched, err := r.matches(v)
+		if err != nil {
+			return nil, fmt.Errorf("policy rule %q: %w", r.Name, err)
+		}
+		if matched {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkPolicy records the policy rule skipping the volume in its report, and
+// returns false when the volume must be left untouched, because a rule skips
+// it or because the policy couldn't be evaluated.
+func (v *EBSVolume) checkPolicy(vr *volumeReport) bool {
+	r, err := v.policyRule()
+	if err != nil {
+		log.Printf("Couldn't evaluate the policy for volume %s in %s: %s\n", *v.VolumeId, v.region, err.Error())
+		vr.needsReview(err.Error())
+		return false
+	}
+	if r != nil && r.Action.Skip {
+		log.Printf("Volume %s in %s is skipped by policy rule %q\n", *v.VolumeId, v.region, r.Name)
+		vr.Policy = &policyReport{Rule: r.Name, Skip: true}
+		vr.skip(fmt.Sprintf("skipped by policy rule %q", r.Name))
+		return false
+	}
+	return true
+}
+
+// applyPolicy replaces the requirements with the ones computed by the rule
+// formulas, and restricts the decision to the target type of the rule. When a
+// formula can't be evaluated the requirements are kept, and the error is
+// recorded in the policy report.
+func (pe *performanceEnvelope) applyPolicy(v *EBSVolume, r *policyRule) {
+	pr := &policyReport{Rule: r.Name, Skip: r.Action.Skip, TargetType: r.Action.TargetType}
+	pe.Policy = pr
+
+	iops, throughput := v.getCurrentConfiguration().delivered()
+	vars := map[string]float64{
+		"size":                float64(aws.ToInt32(v.Size)),
+		"iops":                float64(iops),
+		"throughput":          float64(throughput),
+		"required_iops":       float64(pe.IOPS),
+		"required_throughput": float64(pe.Throughput),
+	}
+
+	if r.iops != nil {
+		n, err := r.iops.evaluate(vars)
+		if err != nil {
+			pr.Error = err.Error()
+			return
+		}
+		pr.IOPS = &n
+	}
+	if r.throughput != nil {
+		n, err := r.throughput.evaluate(vars)
+		if err != nil {
+			pr.Error = err.Error()
+			return
+		}
+		pr.Throughput = &n
+	}
+
+	if pr.IOPS != nil {
+		pe.IOPS = *pr.IOPS
+	}
+	if pr.Throughput != nil {
+		pe.Throughput = *pr.Throughput
+	}
+	if pr.TargetType != "" {
+		pe.TargetType = pr.TargetType
+	}
+}
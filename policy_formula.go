@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// formulaVariables are the volume attributes available in the formulas of the
+// policy actions.
+var formulaVariables = map[string]string{
+	"size":                "size of the volume in GiB",
+	"iops":                "IOPS delivered by the current configuration",
+	"throughput":          "throughput in MiB/s delivered by the current configuration",
+	"required_iops":       "IOPS required before applying the policy",
+	"required_throughput": "throughput in MiB/s required before applying the policy",
+}
+
+// formulaFunctions are the functions available in the formulas, with their
+// minimum and maximum number of arguments, 0 meaning unbounded.
+var formulaFunctions = map[string]struct {
+	minArgs, maxArgs int
+	fn               func(args []float64) float64
+}{
+	"min":   {1, 0, func(args []float64) float64 { return fold(args, math.Min) }},
+	"max":   {1, 0, func(args []float64) float64 { return fold(args, math.Max) }},
+	"ceil":  {1, 1, func(args []float64) float64 { return math.Ceil(args[0]) }},
+	"floor": {1, 1, func(args []float64) float64 { return math.Floor(args[0]) }},
+	"round": {1, 1, func(args []float64) float64 { return math.Round(args[0]) }},
+}
+
+func fold(args []float64, fn func(a, b float64) float64) float64 {
+	r := args[0]
+	for _, a := range args[1:] {
+		r = fn(r, a)
+	}
+	return r
+}
+
+// formula is an arithmetic expression over the volume attributes, such as
+// "max(3000, size * 3)", supporting the + - * / operators, parentheses, the
+// formulaVariables and the formulaFunctions.
+type formula struct {
+	text string
+	root formulaNode
+}
+
+type formulaNode interface {
+	eval(vars map[string]float64) float64
+}
+
+type formulaNumber float64
+
+type formulaVariable string
+
+type formulaUnary struct {
+	operand formulaNode
+}
+
+type formulaBinary struct {
+	op          byte
+	left, right formulaNode
+}
+
+type formulaCall struct {
+	name string
+	args []formulaNode
+}
+
+func (n formulaNumber) eval(map[string]float64) float64 { return float64(n) }
+
+func (n formulaVariable) eval(vars map[string]float64) float64 { return vars[string(n)] }
+
+func (n formulaUnary) eval(vars map[string]float64) float64 { return -n.operand.eval(vars) }
+
+func (n formulaBinary) eval(vars map[string]float64) float64 {
+	l, r := n.left.eval(vars), n.right.eval(vars)
+	switch n.op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	default:
+		return l / r
+	}
+}
+
+func (n formulaCall) eval(vars map[string]float64) float64 {
+	args := make([]float64, len(n.args))
+	for i, a := range n.args {
+		args[i] = a.eval(vars)
+	}
+	return formulaFunctions[n.name].fn(args)
+}
+
+// parseFormula parses the expression, checking that it only uses the known
+// variables and functions.
+func parseFormula(text string) (*formula, error) {
+	p := formulaParser{text: text}
+	p.next()
+
+	root, err := p.expression()
+	if err != nil {
+		return nil, fmt.Errorf("invalid formula %q: %w", text, err)
+	}
+	if p.token != "" {
+		return nil, fmt.Errorf("invalid formula %q: unexpected %q at position %d", text, p.token, p.start)
+	}
+	return &formula{text: text, root: root}, nil
+}
+
+// evaluate computes the formula, rounding the result up to an integer.
+func (f *formula) evaluate(vars map[string]float64) (int32, error) {
+	r := math.Ceil(f.root.eval(vars))
+	if math.IsNaN(r) || math.IsInf(r, 0) || r < 0 || r > math.MaxInt32 {
+		return 0, fmt.Errorf("formula %q evaluated to %v", f.text, r)
+	}
+	return int32(r), nil
+}
+
+// formulaParser is a recursive descent parser of the formulas, where the
+// current token is kept in token, starting at the start position.
+type formulaParser struct {
+	text  string
+	pos   int
+	start int
+	token string
+}
+
+// next advances to the following token, which is empty at the end.
+func (p *formulaParser) next() {
+	for p.pos < len(p.text) && p.text[p.pos] == ' ' {
+		p.pos++
+	}
+	p.start = p.pos
+
+	if p.pos >= len(p.text) {
+		p.token = ""
+		return
+	}
+
+	c := p.text[p.pos]
+	switch {
+	case c >= '0' && c <= '9' || c == '.':
+		for p.pos < len(p.text) && (p.text[p.pos] >= '0' && p.text[p.pos] <= '9' || p.text[p.pos] == '.') {
+			p.pos++
+		}
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for p.pos < len(p.text) && (p.text[p.pos] == '_' || p.text[p.pos] >= 'a' && p.text[p.pos] <= 'z' ||
+			p.text[p.pos] >= 'A' && p.text[p.pos] <= 'Z' || p.text[p.pos] >= '0' && p.text[p.pos] <= '9') {
+			p.pos++
+		}
+	default:
+		p.pos++
+	}
+	p.token = p.text[p.start:p.pos]
+}
+
+// expression parses sums and differences of terms.
+func (p *formulaParser) expression() (formulaNode, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.token == "+" || p.token == "-" {
+		op := p.token[0]
+		p.next()
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = formulaBinary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// term parses products and quotients of factors.
+func (p *formulaParser) term() (formulaNode, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for p.token == "*" || p.token == "/" {
+		op := p.token[0]
+		p.next()
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = formulaBinary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// factor parses numbers, variables, function calls, negations and
+// parenthesized expressions.
+func (p *formulaParser) factor() (formulaNode, error) {
+	token, start := p.token, p.start
+
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end")
+
+	case token == "-":
+		p.next()
+		operand, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return formulaUnary{operand: operand}, nil
+
+	case token == "(":
+		p.next()
+		node, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if p.token != ")" {
+			return nil, fmt.Errorf("missing ')' at position %d", p.start)
+		}
+		p.next()
+		return node, nil
+
+	case token[0] >= '0' && token[0] <= '9' || token[0] == '.':
+		n, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", token, start)
+		}
+		p.next()
+		return formulaNumber(n), nil
+
+	case token[0] == '_' || token[0] >= 'a' && token[0] <= 'z' || token[0] >= 'A' && token[0] <= 'Z':
+		p.next()
+		if p.token == "(" {
+			return p.call(token, start)
+		}
+		if _, found := formulaVariables[token]; !found {
+			return nil, fmt.Errorf("unknown variable %q at position %d, expected one of %s",
+				token, start, strings.Join(formulaVariableNames(), ", "))
+		}
+		return formulaVariable(token), nil
+	}
+
+	return nil, fmt.Errorf("unexpected %q at position %d", token, start)
+}
+
+// call parses the arguments of a function call, starting at the '(' token.
+func (p *formulaParser) call(name string, start int) (formulaNode, error) {
+	f, found := formulaFunctions[name]
+	if !found {
+		return nil, fmt.Errorf("unknown function %q at position %d", name, start)
+	}
+
+	var args []formulaNode
+	p.next()
+	for p.token != ")" {
+		if len(args) > 0 {
+			if p.token != "," {
+				return nil, fmt.Errorf("expected ',' or ')' at position %d", p.start)
+			}
+			p.next()
+		}
+		arg, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next()
+
+	if len(args) < f.minArgs || (f.maxArgs > 0 && len(args) > f.maxArgs) {
+		return nil, fmt.Errorf("wrong number of arguments for %s at position %d", name, start)
+	}
+	return formulaCall{name: name, args: args}, nil
+}
+
+func formulaVariableNames() []string {
+	var names []string
+	for name := range formulaVariables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var testFormulaVariables = map[string]float64{
+	"size":                100,
+	"iops":                300,
+	"throughput":          128,
+	"required_iops":       3000,
+	"required_throughput": 125,
+}
+
+func TestFormulaEvaluate(t *testing.T) {
+	tests := []struct {
+		text string
+		want int32
+	}{
+		{"42", 42},
+		{"1.5", 2},
+		{"size", 100},
+		{"size * 3", 300},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"100 / 10 / 2", 5},
+		{"2 * 3 + 4 * 5", 26},
+		{"-2 + 5", 3},
+		{"-(2 - 5)", 3},
+		{"--3", 3},
+		{"size/3", 34},
+		{"max(3000, size * 3)", 3000},
+		{"max(3000, size * 50)", 5000},
+		{"min(iops, required_iops, 1000)", 300},
+		{"max(1)", 1},
+		{"ceil(size / 3)", 34},
+		{"floor(size / 3)", 33},
+		{"round(2.5)", 3},
+		{"floor(required_throughput * 1.1)", 137},
+		{"max(required_iops, iops * 2) + throughput", 3128},
+		{"  size  *  2  ", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			f, err := parseFormula(tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := f.evaluate(testFormulaVariables)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("%s = %d, want %d", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormulaParseErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", "unexpected end"},
+		{"size *", "unexpected end"},
+		{"disk_size * 3", `unknown variable "disk_size" at position 0`},
+		{"3 * Size", `unknown variable "Size" at position 4`},
+		{"avg(size, 3)", `unknown function "avg" at position 0`},
+		{"(size * 3", "missing ')' at position 9"},
+		{"size * 3)", `unexpected ")" at position 8`},
+		{"size 3", `unexpected "3" at position 5`},
+		{"1..2", `invalid number "1..2" at position 0`},
+		{"size % 2", `unexpected "%" at position 5`},
+		{"min()", "wrong number of arguments for min"},
+		{"ceil(1, 2)", "wrong number of arguments for ceil"},
+		{"max(1 2)", "expected ',' or ')' at position 6"},
+		{"max(1,", "unexpected end"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			_, err := parseFormula(tt.text)
+			if err == nil {
+				t.Fatalf("parsed %q without errors", tt.text)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q doesn't mention %q", err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestFormulaUnknownVariableListsTheKnownOnes(t *testing.T) {
+	_, err := parseFormula("volume_size")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for name := range formulaVariables {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q doesn't list the variable %s", err.Error(), name)
+		}
+	}
+}
+
+func TestFormulaEvaluateErrors(t *testing.T) {
+	tests := []string{
+		"size / 0",
+		"0 / 0",
+		"-size",
+		"size * 100000000",
+	}
+
+	for _, text := range tests {
+		t.Run(text, func(t *testing.T) {
+			f, err := parseFormula(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n, err := f.evaluate(testFormulaVariables); err == nil {
+				t.Errorf("%s evaluated to %d without errors", text, n)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// sampleInventory is the format of the policy inventory file, which is the
+// output of 'aws ec2 describe-volumes', optionally extended with the instances
+// the volumes are attached to, as listed by 'aws ec2 describe-instances'.
+type sampleInventory struct {
+	Volumes   []types.Volume   `json:"Volumes"`
+	Instances []types.Instance `json:"Instances"`
+}
+
+// availabilityZoneRegion matches the region at the beginning of the
+// availability zone names, including those of the Local Zones.
+var availabilityZoneRegion = regexp.MustCompile(`^[a-z]{2}(-gov)?-[a-z]+-\d+`)
+
+// validatePolicy checks the policy file, reporting all its problems, and then
+// evaluates it against the sample inventory, if configured, printing to stdout
+// the outcome for each of its volumes.
+func (e *EBSOptimizer) validatePolicy(report *runReport) {
+	path := e.config.PolicyFile
+	if path == "" {
+		log.Println("No policy file configured, nothing to validate")
+		report.addError("no policy file configured")
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Println("Couldn't read the policy:", err.Error())
+		report.addError("couldn't read the policy: %s", err.Error())
+		return
+	}
+
+	p, problems := parsePolicy(data)
+	for _, problem := range problems {
+		log.Printf("Invalid policy %s: %s\n", path, problem)
+		report.addError("invalid policy: %s", problem)
+	}
+	if len(problems) > 0 {
+		return
+	}
+	fmt.Fprintf(os.Stdout, "Policy %s is valid, with %d rules\n", path, len(p.Rules))
+	policy = p
+
+	if e.config.PolicyInventory == "" {
+		return
+	}
+
+	lines, err := evaluateSampleInventory(e.config.PolicyInventory)
+	if err != nil {
+		log.Println("Couldn't evaluate the policy against the sample inventory:", err.Error())
+		report.addError("couldn't evaluate the policy against the sample inventory: %s", err.Error())
+		return
+	}
+	for _, line := range lines {
+		fmt.Fprintln(os.Stdout, line)
+	}
+}
+
+// evaluateSampleInventory matches the volumes of the inventory file against
+// the policy, describing which rule applies to each of them and the resulting
+// requirements. The instances are only taken from the inventory file.
+func evaluateSampleInventory(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var inv sampleInventory
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return nil, fmt.Errorf("invalid inventory file %s: %w", path, err)
+	}
+
+	instances := newInstanceCache()
+	instances.add(inv.Instances...)
+
+	var lines []string
+	for _, vol := range inv.Volumes {
+		region := availabilityZoneRegion.FindString(aws.ToString(vol.AvailabilityZone))
+		v := &EBSVolume{
+			Volume: vol,
+			region: region,
+			api:    ec2Conn{region: region, instanceCache: instances},
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s, %s %dGB %d IOPS): %s",
+			aws.ToString(vol.VolumeId), region, vol.VolumeType, aws.ToInt32(vol.Size), v.getIOPS(), v.policyOutcome()))
+	}
+	return lines, nil
+}
+
+// policyOutcome describes the policy rule matching the volume and the
+// requirements it results in, based on the current configuration.
+func (v *EBSVolume) policyOutcome() string {
+	r, err := v.policyRule()
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	if r == nil {
+		return "no rule matched, converted as configured by the flags"
+	}
+	if r.Action.Skip {
+		return fmt.Sprintf("rule %q matched, skipped", r.Name)
+	}
+
+	pe := v.defaultPerformanceEnvelope()
+	pe.applyPolicy(v, r)
+	if pe.Policy.Error != "" {
+		return fmt.Sprintf("rule %q matched, failed: %s", r.Name, pe.Policy.Error)
+	}
+
+	target := "any volume type"
+	if pe.TargetType != "" {
+		target = pe.TargetType
+	}
+	return fmt.Sprintf("rule %q matched, requiring %s with at least %d IOPS and %dMiB/s",
+		r.Name, target, pe.IOPS, pe.Throughput)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// testPolicy has overlapping rules, so that the order decides which applies.
+const testPolicy = `{
+	"version": 1,
+	"rules": [
+		{"name": "keep-databases", "match": {"tags": ["role=db*"]}, "action": {"skip": true}},
+		{"name": "large-gp2", "match": {"volumeTypes": ["gp2"], "size": {"min": 1000}}, "action": {"targetType": "gp3", "iops": "size * 3"}},
+		{"name": "europe", "match": {"regions": ["eu-*"]}, "action": {"iops": "max(3000, required_iops)"}},
+		{"name": "production-instances", "match": {"instanceTags": ["env=prod"]}, "action": {"targetType": "io2", "iops": "iops"}},
+		{"name": "gp2", "match": {"volumeTypes": ["gp2"], "tags": ["!no-policy"]}, "action": {"targetType": "gp3"}}
+	]
+}`
+
+func withPolicy(t *testing.T, data string) {
+	p, problems := parsePolicy([]byte(data))
+	if len(problems) > 0 {
+		t.Fatalf("invalid policy: %s", strings.Join(problems, "; "))
+	}
+	saved := policy
+	t.Cleanup(func() { policy = saved })
+	policy = p
+}
+
+func tags(kv ...string) []types.Tag {
+	var tags []types.Tag
+	for i := 0; i+1 < len(kv); i += 2 {
+		tags = append(tags, types.Tag{Key: aws.String(kv[i]), Value: aws.String(kv[i+1])})
+	}
+	return tags
+}
+
+func TestPolicyFirstMatch(t *testing.T) {
+	withPolicy(t, testPolicy)
+
+	instances := newInstanceCache()
+	instances.add(
+		types.Instance{InstanceId: aws.String("i-prod"), Tags: tags("env", "prod")},
+		types.Instance{InstanceId: aws.String("i-dev"), Tags: tags("env", "dev")},
+	)
+
+	tests := []struct {
+		name       string
+		volumeType string
+		size       int32
+		region     string
+		tags       []types.Tag
+		instances  []string
+		want       string
+	}{
+		{"first rule wins over all the others", "gp2", 2000, "eu-west-1", tags("role", "db-primary"), []string{"i-prod"}, "keep-databases"},
+		{"size range lower bound included", "gp2", 1000, "eu-west-1", nil, nil, "large-gp2"},
+		{"size range excluded", "gp2", 999, "eu-west-1", nil, nil, "europe"},
+		{"region glob", "io1", 100, "eu-central-1", nil, []string{"i-prod"}, "europe"},
+		{"instance tags", "io1", 100, "us-east-1", nil, []string{"i-prod"}, "production-instances"},
+		{"any attached instance", "io1", 100, "us-east-1", nil, []string{"i-dev", "i-prod"}, "production-instances"},
+		{"instance tags not matched", "io1", 100, "us-east-1", nil, []string{"i-dev"}, ""},
+		{"tag glob not matched", "gp2", 100, "us-east-1", tags("role", "web"), nil, "gp2"},
+		{"absent tag required", "gp2", 100, "us-east-1", tags("no-policy", ""), nil, ""},
+		{"nothing matched", "st1", 500, "us-east-1", nil, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := testVolume(tt.volumeType, tt.size, 0, 0)
+			v.region = tt.region
+			v.api = ec2Conn{region: tt.region, instanceCache: instances}
+			v.Tags = tt.tags
+			for _, id := range tt.instances {
+				v.Attachments = append(v.Attachments, types.VolumeAttachment{InstanceId: aws.String(id)})
+			}
+
+			r, err := v.policyRule()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if r != nil {
+				got = r.Name
+			}
+			if got != tt.want {
+				t.Errorf("matched rule %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyUnknownInstance(t *testing.T) {
+	withPolicy(t, testPolicy)
+
+	v := testVolume("io1", 100, 1000, 0)
+	v.api.instanceCache = newInstanceCache()
+	v.Attachments = []types.VolumeAttachment{{InstanceId: aws.String("i-missing")}}
+
+	if _, err := v.policyRule(); err == nil || !strings.Contains(err.Error(), "production-instances") {
+		t.Errorf("expected an error about the rule with instance tags, got %v", err)
+	}
+}
+
+func TestPolicyWithoutRules(t *testing.T) {
+	saved := policy
+	t.Cleanup(func() { policy = saved })
+	policy = nil
+
+	if r, err := testVolume("gp2", 100, 300, 0).policyRule(); r != nil || err != nil {
+		t.Errorf("policyRule() = %v, %v without a policy", r, err)
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	withPolicy(t, testPolicy)
+
+	tests := []struct {
+		name       string
+		rule       string
+		volume     *EBSVolume
+		wantType   string
+		wantIOPS   int32
+		wantErrors bool
+	}{
+		{"formula over the size", "large-gp2", testVolume("gp2", 2000, 6000, 0), "gp3", 6000, false},
+		{"formula over the requirements", "europe", testVolume("io1", 100, 5000, 0), "", 5000, false},
+		{"formula over the delivered IOPS", "production-instances", testVolume("io1", 100, 4000, 0), "io2", 4000, false},
+		{"only the target type", "gp2", testVolume("gp2", 100, 300, 0), "gp3", 300, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rule *policyRule
+			for i := range policy.Rules {
+				if policy.Rules[i].Name == tt.rule {
+					rule = &policy.Rules[i]
+				}
+			}
+
+			pe := tt.volume.defaultPerformanceEnvelope()
+			pe.applyPolicy(tt.volume, rule)
+
+			if pe.Policy == nil || pe.Policy.Rule != tt.rule {
+				t.Fatalf("policy report %+v, want rule %q", pe.Policy, tt.rule)
+			}
+			if (pe.Policy.Error != "") != tt.wantErrors {
+				t.Errorf("policy error %q", pe.Policy.Error)
+			}
+			if pe.TargetType != tt.wantType || pe.IOPS != tt.wantIOPS {
+				t.Errorf("required %q with %d IOPS, want %q with %d IOPS", pe.TargetType, pe.IOPS, tt.wantType, tt.wantIOPS)
+			}
+		})
+	}
+}
+
+func TestParsePolicyProblems(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   []string
+	}{
+		{
+			name:   "unknown field",
+			policy: `{"version": 1, "rules": [{"name": "a", "match": {"volumeType": ["gp2"]}, "action": {"skip": true}}]}`,
+			want:   []string{`unknown field "volumeType"`},
+		},
+		{
+			name:   "unknown YAML field",
+			policy: "version: 1\nrules:\n- name: a\n  match: {volumeType: [gp2]}\n  action: {skip: true}\n",
+			want:   []string{`unknown field "volumeType"`},
+		},
+		{
+			name:   "invalid YAML",
+			policy: "version: 1\nrules:\n\t- name: a\n",
+			want:   []string{"yaml:"},
+		},
+		{
+			name:   "version and rules",
+			policy: `{"version": 2, "rules": []}`,
+			want:   []string{"unsupported policy version 2", "no rules"},
+		},
+		{
+			name: "all the problems of the rules",
+			policy: `{"version": 1, "rules": [
+				{"name": "a", "match": {"volumeTypes": ["gp4"], "size": {"min": 10, "max": 5}}, "action": {"skip": true, "targetType": "gp3"}},
+				{"name": "a", "action": {"iops": "size * x"}},
+				{"name": "", "match": {"tags": ["=x"]}, "action": {}},
+				{"name": "b", "action": {"targetType": "standard", "throughput": "max("}}
+			]}`,
+			want: []string{
+				`rule 1 "a": unknown volume type "gp4"`,
+				`rule 1 "a": invalid size range: min 10 above max 5`,
+				`rule 1 "a": the skip action can't be combined with other actions`,
+				`rule 2 "a": duplicate name`,
+				`rule 2 "a": invalid formula "size * x": unknown variable "x"`,
+				`rule 3 "": missing name`,
+				`rule 3 "": invalid tag expression "=x": missing tag key`,
+				`rule 3 "": missing action`,
+				`rule 4 "b": previous generation target volume type "standard"`,
+				`rule 4 "b": invalid formula "max(": unexpected end`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, problems := parsePolicy([]byte(tt.policy))
+			if p != nil {
+				t.Error("returned a policy despite the problems")
+			}
+			if len(problems) != len(tt.want) {
+				t.Errorf("got %d problems, want %d:\n%s", len(problems), len(tt.want), strings.Join(problems, "\n"))
+			}
+			for _, want := range tt.want {
+				found := false
+				for _, problem := range problems {
+					found = found || strings.Contains(problem, want)
+				}
+				if !found {
+					t.Errorf("missing problem %q in:\n%s", want, strings.Join(problems, "\n"))
+				}
+			}
+		})
+	}
+}
+
+// testYAMLPolicy is testPolicy written in YAML.
+const testYAMLPolicy = `
+version: 1
+rules:
+  - name: keep-databases
+    match:
+      tags: ["role=db*"]
+    action:
+      skip: true
+  - name: large-gp2
+    match:
+      volumeTypes: [gp2]
+      size: {min: 1000}
+    action:
+      targetType: gp3
+      iops: size * 3
+  - name: europe
+    match:
+      regions: ["eu-*"]
+    action:
+      iops: max(3000, required_iops)
+  - name: production-instances
+    match:
+      instanceTags: [env=prod]
+    action:
+      targetType: io2
+      iops: iops
+  - name: gp2
+    match:
+      volumeTypes: [gp2]
+      tags: ["!no-policy"]
+    action:
+      targetType: gp3
+`
+
+func TestParsePolicyYAML(t *testing.T) {
+	fromJSON, problems := parsePolicy([]byte(testPolicy))
+	if len(problems) > 0 {
+		t.Fatalf("invalid JSON policy: %s", strings.Join(problems, "; "))
+	}
+	fromYAML, problems := parsePolicy([]byte(testYAMLPolicy))
+	if len(problems) > 0 {
+		t.Fatalf("invalid YAML policy: %s", strings.Join(problems, "; "))
+	}
+
+	want, _ := json.Marshal(fromJSON)
+	got, _ := json.Marshal(fromYAML)
+	if string(got) != string(want) {
+		t.Errorf("YAML policy %s, want %s", got, want)
+	}
+}
+
+func TestTagExpression(t *testing.T) {
+	volumeTags := tags("env", "prod", "team", "storage/backup")
+
+	tests := []struct {
+		expression string
+		want       bool
+	}{
+		{"env", true},
+		{"owner", false},
+		{"!owner", true},
+		{"!env", false},
+		{"env=prod", true},
+		{"env=prod*", true},
+		{"env=dev", false},
+		{"env!=dev", true},
+		{"env!=prod", false},
+		{"owner!=prod", false},
+		{"team=storage/*", true},
+		{" env = prod ", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			te, err := parseTagExpression(tt.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := te.matches(volumeTags); got != tt.want {
+				t.Errorf("%q matched %v, want %v", tt.expression, got, tt.want)
+			}
+		})
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"regexp"
+	"math"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -32,45 +34,111 @@ type Pricing struct {
 			MaxVolumeSize       string `json:"maxVolumeSize"`
 			Operation           string `json:"operation"`
 			Group               string `json:"group"`
+			RegionCode          string `json:"regionCode"`
 		} `json:"attributes"`
 		Sku string `json:"sku"`
 	} `json:"product"`
 	ServiceCode string `json:"serviceCode"`
 	Terms       struct {
-		OnDemand struct {
-			SKU struct {
-				PriceDimensions struct {
-					Dimension struct {
-						Unit         string        `json:"unit"`
-						EndRange     string        `json:"endRange"`
-						Description  string        `json:"description"`
-						AppliesTo    []interface{} `json:"appliesTo"`
-						RateCode     string        `json:"rateCode"`
-						BeginRange   string        `json:"beginRange"`
-						PricePerUnit struct {
-							USD string `json:"USD"`
-						} `json:"pricePerUnit"`
-					} `json:"Dimension"`
-				} `json:"priceDimensions"`
-				Sku            string    `json:"sku"`
-				EffectiveDate  time.Time `json:"effectiveDate"`
-				OfferTermCode  string    `json:"offerTermCode"`
-				TermAttributes struct {
-				} `json:"termAttributes"`
-			} `json:"SKU"`
-		} `json:"OnDemand"`
+		// keyed by the SKU and offer term code
+		OnDemand map[string]offerTerm `json:"OnDemand"`
 	} `json:"terms"`
 	Version         string    `json:"version"`
 	PublicationDate time.Time `json:"publicationDate"`
 }
 
+type offerTerm struct {
+	// keyed by the SKU, offer term code and rate code
+	PriceDimensions map[string]priceDimension `json:"priceDimensions"`
+	Sku             string                    `json:"sku"`
+	EffectiveDate   time.Time                 `json:"effectiveDate"`
+	OfferTermCode   string                    `json:"offerTermCode"`
+}
+
+type priceDimension struct {
+	Unit         string            `json:"unit"`
+	EndRange     string            `json:"endRange"`
+	Description  string            `json:"description"`
+	AppliesTo    []interface{}     `json:"appliesTo"`
+	RateCode     string            `json:"rateCode"`
+	BeginRange   string            `json:"beginRange"`
+	PricePerUnit map[string]string `json:"pricePerUnit"`
+}
+
+// dimension is a price dimension with its range and USD price parsed as
+// numbers. The endRange of unbounded dimensions is +Inf.
+type dimension struct {
+	beginRange float64
+	endRange   float64
+	unit       string
+	price      float64
+}
+
+// unbounded returns true if the dimension covers the whole usage range.
+func (d *dimension) unbounded() bool {
+	return d.beginRange == 0 && math.IsInf(d.endRange, 1)
+}
+
+// dimensions parses the price dimensions of all the on-demand terms of the
+// product, sorted by their beginRange.
+func (p *Pricing) dimensions() ([]dimension, error) {
+	var dims []dimension
+
+	for _, term := range p.Terms.OnDemand {
+		for rateCode, pd := range term.PriceDimensions {
+			d, err := pd.parse()
+			if err != nil {
+				return nil, fmt.Errorf("invalid price dimension %s: %w", rateCode, err)
+			}
+			dims = append(dims, *d)
+		}
+	}
+
+	if len(dims) == 0 {
+		return nil, fmt.Errorf("no on-demand price dimensions for SKU %s", p.Product.Sku)
+	}
+
+	sort.Slice(dims, func(i, j int) bool {
+		return dims[i].beginRange < dims[j].beginRange
+	})
+	return dims, nil
+}
+
+func (pd *priceDimension) parse() (*dimension, error) {
+	var err error
+
+	d := dimension{unit: pd.Unit, endRange: math.Inf(1)}
+
+	usd, found := pd.PricePerUnit["USD"]
+	if !found {
+		return nil, fmt.Errorf("missing USD price")
+	}
+	if d.price, err = strconv.ParseFloat(usd, 64); err != nil {
+		return nil, fmt.Errorf("failed to convert price %s to float: %w", usd, err)
+	}
+
+	if pd.BeginRange != "" {
+		if d.beginRange, err = strconv.ParseFloat(pd.BeginRange, 64); err != nil {
+			return nil, fmt.Errorf("failed to convert beginRange %s to float: %w", pd.BeginRange, err)
+		}
+	}
+
+	// strconv parses the "Inf" value used by the Pricing API for unbounded ranges
+	if pd.EndRange != "" {
+		if d.endRange, err = strconv.ParseFloat(pd.EndRange, 64); err != nil {
+			return nil, fmt.Errorf("failed to convert endRange %s to float: %w", pd.EndRange, err)
+		}
+	}
+	return &d, nil
+}
+
 func getPricingData(filters []types.Filter) ([]Pricing, error) {
 
 	var priceList []Pricing
 
 	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("us-east-1"))
 	if err != nil {
-		log.Fatalf("unable to load SDK config, %v", err)
+		return nil, fmt.Errorf("unable to load SDK config, %w", err)
 	}
 	// Create a Pricing client with additional configuration
 	svc := pricing.NewFromConfig(cfg)
@@ -91,21 +159,15 @@ func getPricingData(filters []types.Filter) ([]Pricing, error) {
 		}
 		debug.Println("page contents: ", page.PriceList)
 
-		var p Pricing
-
 		for _, item := range page.PriceList {
+			var p Pricing
 
-			dimension := regexp.MustCompile(`\"\w{16,}\.\w{10,}\.\w{10,}\"`)
-			itemDimension := dimension.ReplaceAll([]byte(item), []byte("\"Dimension\""))
-
-			sku := regexp.MustCompile(`\"\w{16,}\.\w{10,}\"`)
-			itemSKU := sku.ReplaceAll(itemDimension, []byte("\"SKU\""))
-
-			//	fmt.Printf("%v", string(itemSKU))
-
-			err := json.Unmarshal(itemSKU, &p)
+			// the region of an unparsable product is unknown, so its pricing
+			// can't be reported as missing and the whole data is discarded
+			err := json.Unmarshal([]byte(item), &p)
 			if err != nil {
-				fmt.Println("error: ", err.Error())
+				log.Printf("Failed to parse a product of the pricing data: %s\n", err.Error())
+				return nil, fmt.Errorf("failed to parse a product, %w", err)
 			}
 			priceList = append(priceList, p)
 		}
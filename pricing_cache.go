@@ -0,0 +1,187 @@
+package main
+
+import (
+	// needed for embedding the pricing snapshot
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// pricingCacheVersion is increased whenever the format of the pricing cache
+// changes, invalidating the previously persisted cache files.
+const pricingCacheVersion = 2
+
+// pricingSnapshot is the last-resort pricing data, used when the Pricing API
+// and the cache are both unavailable. It has the same format as the cache file,
+// and it's regenerated for all regions by scripts/update_pricing_snapshot.sh.
+//
+//go:embed pricing_snapshot.json
+var pricingSnapshot []byte
+
+// pricingCache is the persisted form of the pricing data stored in ebsInfo.
+type pricingCache struct {
+	Version   int                                         `json:"version"`
+	Generated time.Time                                   `json:"generated"`
+	Volumes   map[string]map[string]cachedRegionalPricing `json:"volumes"`
+
+	// the volume limits advertised by the Pricing API, by region and volume type
+	Capabilities map[string]map[string]volumeCapability `json:"capabilities,omitempty"`
+}
+
+type cachedRegionalPricing struct {
+	PricePerGB  float64           `json:"pricePerGB"`
+	PIOPSPrices []cachedPriceTier `json:"piopsPrices,omitempty"`
+	TputPrices  []cachedPriceTier `json:"tputPrices,omitempty"`
+}
+
+type cachedPriceTier struct {
+	BeginRange int32   `json:"beginRange"`
+	EndRange   int32   `json:"endRange"`
+	Price      float64 `json:"price"`
+}
+
+// loadPricing populates the pricing data in ebsInfo, reusing the cache file
+// while it's fresh. When the Pricing API fails it falls back to the stale
+// cache, and then to the pricing snapshot embedded in the binary.
+func loadPricing(cfg *Config) error {
+
+	cache, err := readPricingCache(cfg.PricingCacheFile)
+	if err != nil {
+		debug.Println("Couldn't read the pricing cache:", err.Error())
+	}
+
+	if cache != nil && time.Since(cache.Generated) < cfg.PricingCacheTTL {
+		log.Printf("Using the cached pricing data from %s, generated at %s\n",
+			cfg.PricingCacheFile, cache.Generated.Format(time.RFC3339))
+		cache.apply()
+		return nil
+	}
+
+	err = populateEBSPricing()
+	if err == nil {
+		if err := newPricingCache().write(cfg.PricingCacheFile); err != nil {
+			log.Println("Couldn't persist the pricing cache:", err.Error())
+		}
+		return nil
+	}
+	log.Println("Failed to fetch the pricing data:", err.Error())
+
+	if cache == nil {
+		cache, err = parsePricingSnapshot(pricingSnapshot, cfg.PricingSnapshotMaxAge)
+		if err != nil {
+			return fmt.Errorf("couldn't use the embedded pricing snapshot: %w", err)
+		}
+		log.Println("Using the pricing snapshot embedded in the binary")
+	}
+
+	log.Printf("WARNING: stale pricing since %s\n", cache.Generated.Format(time.RFC3339))
+	cache.apply()
+	return nil
+}
+
+func newPricingCache() *pricingCache {
+	pc := pricingCache{
+		Version:   pricingCacheVersion,
+		Generated: time.Now(),
+		Volumes:   make(map[string]map[string]cachedRegionalPricing),
+
+		Capabilities: learnedCapabilities,
+	}
+
+	for name, vi := range ebsInfo {
+		regions := make(map[string]cachedRegionalPricing)
+		for region, rp := range vi.Pricing {
+			crp := cachedRegionalPricing{PricePerGB: rp.pricePerGB}
+			for _, p := range rp.piopsPrices {
+				crp.PIOPSPrices = append(crp.PIOPSPrices, cachedPriceTier{p.beginRange, p.endRange, p.pricePerPIOPS})
+			}
+			for _, p := range rp.tputPrices {
+				crp.TputPrices = append(crp.TputPrices, cachedPriceTier{p.beginRange, p.endRange, p.tputPricePerMBps})
+			}
+			regions[region] = crp
+		}
+		pc.Volumes[name] = regions
+	}
+	return &pc
+}
+
+// apply replaces the pricing data in ebsInfo with the cached one.
+func (pc *pricingCache) apply() {
+	for name, vi := range ebsInfo {
+		vi.Pricing = make(volumePricing)
+
+		for region, crp := range pc.Volumes[name] {
+			rp := regionalPricing{pricePerGB: crp.PricePerGB}
+			for _, p := range crp.PIOPSPrices {
+				rp.piopsPrices = append(rp.piopsPrices, piopsPrice{p.BeginRange, p.EndRange, p.Price})
+			}
+			for _, p := range crp.TputPrices {
+				rp.tputPrices = append(rp.tputPrices, tputPrice{p.BeginRange, p.EndRange, p.Price})
+			}
+			vi.Pricing[region] = rp
+		}
+		ebsInfo[name] = vi
+	}
+
+	learnedCapabilities = make(map[string]map[string]volumeCapability)
+	for region, c := range pc.Capabilities {
+		learnedCapabilities[region] = c
+	}
+}
+
+func readPricingCache(path string) (*pricingCache, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePricingCache(data)
+}
+
+func parsePricingCache(data []byte) (*pricingCache, error) {
+	var pc pricingCache
+	if err := json.Unmarshal(data, &pc); err != nil {
+		return nil, err
+	}
+
+	if pc.Version != pricingCacheVersion {
+		return nil, fmt.Errorf("unsupported pricing cache version %d, expected %d", pc.Version, pricingCacheVersion)
+	}
+	return &pc, nil
+}
+
+// parsePricingSnapshot parses the embedded pricing snapshot, which is only
+// trusted if it has the current format and it's not older than maxAge.
+func parsePricingSnapshot(data []byte, maxAge time.Duration) (*pricingCache, error) {
+	pc, err := parsePricingCache(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if pc.Generated.IsZero() {
+		return nil, fmt.Errorf("missing generation time")
+	}
+	if age := time.Since(pc.Generated); maxAge > 0 && age > maxAge {
+		return nil, fmt.Errorf("generated at %s, more than %s ago", pc.Generated.Format(time.RFC3339), maxAge)
+	}
+	return pc, nil
+}
+
+func (pc *pricingCache) write(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(pc, "", "  ")
+	if err != nil {
+		return err
+	}
+	debug.Println("Persisting the pricing cache to", path)
+	return ioutil.WriteFile(path, data, 0644)
+}
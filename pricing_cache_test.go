@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePricingSnapshot(t *testing.T) {
+	snapshot := func(version int, generated time.Time) []byte {
+		return []byte(fmt.Sprintf(`{"version": %d, "generated": %q, "volumes": {"gp3": {"us-east-1": {"pricePerGB": 0.08}}}}`,
+			version, generated.Format(time.RFC3339)))
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		data    []byte
+		maxAge  time.Duration
+		wantErr string
+	}{
+		{"fresh", snapshot(pricingCacheVersion, now.Add(-24*time.Hour)), 30 * 24 * time.Hour, ""},
+		{"too old", snapshot(pricingCacheVersion, now.Add(-31*24*time.Hour)), 30 * 24 * time.Hour, "ago"},
+		{"age check disabled", snapshot(pricingCacheVersion, now.AddDate(-5, 0, 0)), 0, ""},
+		{"other format version", snapshot(pricingCacheVersion-1, now), 30 * 24 * time.Hour, "unsupported pricing cache version"},
+		{"missing generation time", []byte(fmt.Sprintf(`{"version": %d}`, pricingCacheVersion)), 0, "missing generation time"},
+		{"invalid JSON", []byte(`{"version": `), 0, "unexpected end"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc, err := parsePricingSnapshot(tt.data, tt.maxAge)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if pc.Volumes["gp3"]["us-east-1"].PricePerGB != 0.08 {
+					t.Errorf("parsed the pricing %+v", pc.Volumes)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error about %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestEmbeddedPricingSnapshot(t *testing.T) {
+	if _, err := parsePricingSnapshot(pricingSnapshot, 0); err != nil {
+		t.Fatalf("invalid embedded pricing snapshot: %s", err)
+	}
+}
@@ -1,12 +1,10 @@
 package main
 
 import (
-	"context"
+	"fmt"
 	"log"
 	"path/filepath"
 	"strings"
-
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
 )
 
 type region struct {
@@ -16,8 +14,16 @@ type region struct {
 
 	api ec2Conn
 
-	ebsVolumes []*EBSVolume
-	savings    float64
+	filter *volumeFilter
+
+	savings float64
+
+	// number of volumes lacking pricing data, per volume type
+	missingPricing map[string]int
+
+	report *regionReport
+
+	tracker *modificationTracker
 }
 
 // var regionMap = map[string]string{
@@ -62,12 +68,28 @@ var reverseRegionMap = map[string]string{
 	"US West (Oregon)":          "us-west-2",
 }
 
+// regionCodes maps the location names used by the Pricing API to the region
+// codes learned from the regionCode attribute of the products.
+var regionCodes = make(map[string]string)
+
+func learnRegionCode(location, code string) {
+	if location == "" || code == "" || regionCodes[location] == code {
+		return
+	}
+	debug.Printf("Learned region code %s for location %q\n", code, location)
+	regionCodes[location] = code
+}
+
+// getRegion converts a Pricing API location name to a region code, using the
+// codes learned from the Pricing API and then the static reverseRegionMap.
 func getRegion(regionDescription string) string {
-	r := reverseRegionMap[regionDescription]
-	if r == "" {
-		return regionDescription
+	if r := regionCodes[regionDescription]; r != "" {
+		return r
 	}
-	return r
+	if r := reverseRegionMap[regionDescription]; r != "" {
+		return r
+	}
+	return regionDescription
 }
 
 func (r *region) enabled() bool {
@@ -93,35 +115,123 @@ func (r *region) enabled() bool {
 	return false
 }
 
-func (r *region) scanEBSVolumes() error {
-	resp, err := r.api.ec2.DescribeVolumes(context.TODO(), &ec2.DescribeVolumesInput{})
+// processEBSVolumes streams the volumes of the region, accumulating the savings
+// achieved so far and, if the region is enabled, converting the volumes to
+// their optimal configuration. The savings are metered for all the volumes of
+// the region, regardless of the filters of the current execution, and they are
+// calculated before converting the volumes, so that they only account for the
+// previous executions. Volume failures are recorded in the report without
+// stopping the processing of the other volumes, and the returned error is only
+// about listing the volumes. The deferred volumes are only reported, and they
+// are planned again by the later executions whose scope still includes them.
+func (r *region) processEBSVolumes() error {
+
+	enabled := r.enabled()
+	r.report.Enabled = enabled
+	if enabled {
+		log.Printf("Enabled to run in %s, processing region.\n", r.name)
+	} else {
+		debug.Println("Not enabled to run in", r.name)
+		debug.Println("List of enabled regions:", r.conf.Regions)
+	}
+
+	inv := r.inventory()
+	inv.excluded = r.countExcluded
 
-	if err != nil {
-		log.Println("Could not scan volumes", err.Error())
-		return err
+	var err error
+	if !enabled || inv.filtered() {
+		// the volumes filtered on the server side are never listed by the
+		// inventory, so the savings need a separate complete listing
+		err = r.calculateSavings()
+	} else {
+		inv.listed = r.addSavings
 	}
 
-	for _, v := range resp.Volumes {
-		r.ebsVolumes = append(r.ebsVolumes, &EBSVolume{Volume: v, api: r.api, region: r.name})
+	if err == nil && enabled {
+		err = inv.forEach(func(v *EBSVolume) error {
+			var vr *volumeReport
+			if r.conf.Mode == ModePlan {
+				vr, _ = v.plan()
+			} else {
+				vr = v.process()
+			}
+			r.report.addVolume(vr)
+			r.track(v, vr)
+			if vr.failed() {
+				log.Println("Could not convert volume", *v.VolumeId, vr.Error)
+			}
+			return nil
+		})
 	}
-	return nil
+
+	r.report.Totals.AchievedMonthlySavings = r.savings * 730
+	r.waitForModifications()
+	return err
 }
 
-func (r *region) processEBSVolumes() error {
-	for _, v := range r.ebsVolumes {
-		err := v.process()
-		if err != nil {
-			log.Println("Could not convert volume", v, err.Error())
-			return err
-		}
+// calculateSavings lists all the volumes of the region, accumulating the
+// savings achieved by the previous executions.
+func (r *region) calculateSavings() error {
+	all := &inventory{api: r.api, region: r.name}
+	return all.forEach(func(v *EBSVolume) error {
+		r.addSavings(v)
+		return nil
+	})
+}
+
+func (r *region) addSavings(v *EBSVolume) {
+	r.checkPricing(v)
+	r.savings += v.calculateHourlySavings()
+}
+
+// countExcluded counts the volumes excluded by the tag filters on the client
+// side, which aren't reported individually so that the report doesn't grow
+// with the number of volumes in the account. The volumes already excluded on
+// the server side aren't listed at all.
+func (r *region) countExcluded(v *EBSVolume, reason string) {
+	r.report.Totals.Excluded++
+}
+
+// checkPricing counts the volumes whose type has no pricing data in the region,
+// for which the savings would otherwise silently be zero.
+func (r *region) checkPricing(v *EBSVolume) {
+	vt := string(v.VolumeType)
+	if ebsInfo[vt].Pricing[r.name].pricePerGB > 0 {
+		return
 	}
-	return nil
+	if r.missingPricing == nil {
+		r.missingPricing = make(map[string]int)
+	}
+	r.missingPricing[vt]++
 }
 
-func (r *region) calculateHourlySavings() {
-	var savings float64
-	for _, v := range r.ebsVolumes {
-		savings += v.calculateHourlySavings()
+// reportMissingPricing logs the volume types lacking pricing data and adds
+// them to the report.
+func (r *region) reportMissingPricing() {
+	for vt, count := range r.missingPricing {
+		msg := fmt.Sprintf("no pricing data for %d %s volumes, their costs and savings are not accounted for", count, vt)
+		log.Printf("WARNING: %s in %s\n", msg, r.name)
+		r.report.addNote(msg)
 	}
-	r.savings = savings
+}
+
+func (r *region) rollbackEBSVolumes() error {
+
+	r.report.Enabled = true
+
+	inv := r.inventory()
+	inv.excluded = r.countExcluded
+
+	err := inv.forEach(func(v *EBSVolume) error {
+		vr := v.rollback(r.conf.RollbackTo)
+		r.report.addVolume(vr)
+		r.track(v, vr)
+		if vr.failed() {
+			log.Println("Could not roll back volume", *v.VolumeId, vr.Error)
+		}
+		return nil
+	})
+
+	r.waitForModifications()
+	return err
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions taken on the volumes, as shown in the run report.
+const (
+	ActionSkipped  = "skipped"
+	ActionModified = "modified"
+	ActionFailed   = "failed"
+	ActionDryRun   = "dry-run"
+	ActionPlanned  = "planned"
+	ActionDeferred = "deferred"
+	// ActionNeedsReview is used for the volumes that can't be safely converted
+	// to a cheaper configuration, based on the evidence in the report.
+	ActionNeedsReview = "needs-review"
+	// ActionIneligible is used for the volumes that the compatibility rules
+	// don't allow to modify.
+	ActionIneligible = "ineligible"
+)
+
+// runReport is the machine-readable outcome of an execution, written to the
+// report file and returned by the Lambda handler.
+type runReport struct {
+	RunID      string          `json:"runId"`
+	Version    string          `json:"version"`
+	Mode       string          `json:"mode"`
+	DryRun     bool            `json:"dryRun"`
+	StartedAt  time.Time       `json:"startedAt"`
+	FinishedAt time.Time       `json:"finishedAt"`
+	Regions    []*regionReport `json:"regions"`
+	Totals     reportTotals    `json:"totals"`
+
+	// errors not related to a particular region or volume
+	Errors []string `json:"errors,omitempty"`
+
+	// summary of all the failures, set once the run finished, so that the
+	// Lambda invocations succeed and still return them in the payload
+	Failures []string `json:"failures,omitempty"`
+
+	mutex sync.Mutex
+}
+
+type regionReport struct {
+	Region  string          `json:"region"`
+	Enabled bool            `json:"enabled"`
+	Volumes []*volumeReport `json:"volumes"`
+	Notes   []string        `json:"notes,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Totals  reportTotals    `json:"totals"`
+}
+
+type volumeReport struct {
+	VolumeID          string        `json:"volumeId"`
+	Current           *volumeConfig `json:"current"`
+	Target            *volumeConfig `json:"target,omitempty"`
+	MonthlyCostBefore float64       `json:"monthlyCostBefore"`
+	MonthlyCostAfter  float64       `json:"monthlyCostAfter"`
+	Action            string        `json:"action"`
+	Reason            string        `json:"reason,omitempty"`
+	Error             string        `json:"error,omitempty"`
+	Candidates        []candidate   `json:"candidates,omitempty"`
+
+	// the usage according to the metrics, when the target is based on it
+	Usage       *volumeUsage       `json:"usage,omitempty"`
+	Utilization *utilizationReport `json:"utilization,omitempty"`
+	Burst       *burstReport       `json:"burst,omitempty"`
+
+	InstanceClamp *instanceClamp   `json:"instanceClamp,omitempty"`
+	Overrides     *volumeOverrides `json:"overrides,omitempty"`
+	Policy        *policyReport    `json:"policy,omitempty"`
+
+	// time after which a deferred volume can be modified
+	EligibleAt *time.Time `json:"eligibleAt,omitempty"`
+
+	Modification *modificationReport `json:"modification,omitempty"`
+}
+
+type reportTotals struct {
+	Volumes           int     `json:"volumes"`
+	Modified          int     `json:"modified"`
+	DryRun            int     `json:"dryRun"`
+	Planned           int     `json:"planned"`
+	Deferred          int     `json:"deferred"`
+	NeedsReview       int     `json:"needsReview"`
+	Ineligible        int     `json:"ineligible"`
+	Skipped           int     `json:"skipped"`
+	Failed            int     `json:"failed"`
+	MonthlyCostBefore float64 `json:"monthlyCostBefore"`
+	MonthlyCostAfter  float64 `json:"monthlyCostAfter"`
+	MonthlySavings    float64 `json:"monthlySavings"`
+
+	// volumes listed but excluded by the tag filters, which aren't part of
+	// the reported volumes
+	Excluded int `json:"excluded"`
+
+	// savings achieved by the previous executions, compared to the initial
+	// configuration of the volumes
+	AchievedMonthlySavings float64 `json:"achievedMonthlySavings"`
+}
+
+func newRunReport(c *Config) *runReport {
+	return &runReport{
+		RunID:     c.RunID,
+		Version:   c.Version,
+		Mode:      c.Mode,
+		DryRun:    c.DryRun,
+		StartedAt: time.Now(),
+	}
+}
+
+// newRunID generates a unique ID for the execution, prefixed by its start time.
+func newRunID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		debug.Println("Couldn't generate a random run ID suffix:", err.Error())
+	}
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+func newVolumeReport(v *EBSVolume) *volumeReport {
+	vc := v.getCurrentConfiguration()
+	price := vc.calculateMonthlyPrice()
+	return &volumeReport{
+		VolumeID:          *v.VolumeId,
+		Current:           vc,
+		MonthlyCostBefore: price,
+		MonthlyCostAfter:  price,
+	}
+}
+
+// setTarget records the target configuration of the volume and its price.
+func (vr *volumeReport) setTarget(target *volumeConfig) {
+	t := *target
+	vr.Target = &t
+	vr.MonthlyCostAfter = t.calculateMonthlyPrice()
+}
+
+func (vr *volumeReport) skip(reason string) {
+	vr.Action, vr.Reason = ActionSkipped, reason
+	vr.MonthlyCostAfter = vr.MonthlyCostBefore
+}
+
+func (vr *volumeReport) fail(err error) {
+	vr.Action, vr.Error = ActionFailed, err.Error()
+	vr.MonthlyCostAfter = vr.MonthlyCostBefore
+}
+
+// needsReview records that the volume is left unchanged until reviewed, while
+// keeping the target which was considered unsafe.
+func (vr *volumeReport) needsReview(reason string) {
+	vr.Action, vr.Reason = ActionNeedsReview, reason
+	vr.MonthlyCostAfter = vr.MonthlyCostBefore
+}
+
+// ineligible records that the volume can't be modified, with the reason.
+func (vr *volumeReport) ineligible(reason string) {
+	vr.Action, vr.Reason = ActionIneligible, reason
+	vr.MonthlyCostAfter = vr.MonthlyCostBefore
+}
+
+// deferUntil records that the volume can only be modified after the given time.
+func (vr *volumeReport) deferUntil(eligibleAt time.Time, reason string) {
+	vr.Action, vr.Reason = ActionDeferred, reason
+	vr.EligibleAt = &eligibleAt
+	vr.MonthlyCostAfter = vr.MonthlyCostBefore
+}
+
+// applied records the successful modification of the volume.
+func (vr *volumeReport) applied(reason string) {
+	vr.Action, vr.Reason = ActionModified, reason
+	if conf.DryRun {
+		vr.Action = ActionDryRun
+	}
+}
+
+func (vr *volumeReport) failed() bool {
+	return vr.Action == ActionFailed
+}
+
+func (rr *regionReport) addVolume(vr *volumeReport) {
+	rr.Volumes = append(rr.Volumes, vr)
+	rr.Totals.add(vr)
+}
+
+// recomputeTotals updates the volume totals of the region, after the outcome
+// of some of its volumes changed.
+func (rr *regionReport) recomputeTotals() {
+	rr.Totals = reportTotals{
+		Excluded:               rr.Totals.Excluded,
+		AchievedMonthlySavings: rr.Totals.AchievedMonthlySavings,
+	}
+	for _, vr := range rr.Volumes {
+		rr.Totals.add(vr)
+	}
+}
+
+func (rr *regionReport) addNote(format string, args ...interface{}) {
+	rr.Notes = append(rr.Notes, fmt.Sprintf(format, args...))
+}
+
+func (t *reportTotals) add(vr *volumeReport) {
+	t.Volumes++
+	switch vr.Action {
+	case ActionModified:
+		t.Modified++
+	case ActionDryRun:
+		t.DryRun++
+	case ActionPlanned:
+		t.Planned++
+	case ActionDeferred:
+		t.Deferred++
+	case ActionNeedsReview:
+		t.NeedsReview++
+	case ActionIneligible:
+		t.Ineligible++
+	case ActionSkipped:
+		t.Skipped++
+	case ActionFailed:
+		t.Failed++
+	}
+	t.MonthlyCostBefore += vr.MonthlyCostBefore
+	t.MonthlyCostAfter += vr.MonthlyCostAfter
+	t.MonthlySavings += vr.MonthlyCostBefore - vr.MonthlyCostAfter
+}
+
+func (t *reportTotals) merge(other reportTotals) {
+	t.Volumes += other.Volumes
+	t.Modified += other.Modified
+	t.DryRun += other.DryRun
+	t.Planned += other.Planned
+	t.Deferred += other.Deferred
+	t.NeedsReview += other.NeedsReview
+	t.Ineligible += other.Ineligible
+	t.Skipped += other.Skipped
+	t.Failed += other.Failed
+	t.MonthlyCostBefore += other.MonthlyCostBefore
+	t.MonthlyCostAfter += other.MonthlyCostAfter
+	t.MonthlySavings += other.MonthlySavings
+	t.Excluded += other.Excluded
+	t.AchievedMonthlySavings += other.AchievedMonthlySavings
+}
+
+// addRegion adds the report of a region, and is safe for concurrent use.
+func (r *runReport) addRegion(rr *regionReport) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Regions = append(r.Regions, rr)
+	r.Totals.merge(rr.Totals)
+}
+
+// addError records an execution-level error, and is safe for concurrent use.
+func (r *runReport) addError(format string, args ...interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// failures lists all the errors encountered during the execution, at the run,
+// region and volume levels.
+func (r *runReport) failures() []string {
+	var failures []string
+
+	failures = append(failures, r.Errors...)
+	for _, rr := range r.Regions {
+		if rr.Error != "" {
+			failures = append(failures, fmt.Sprintf("%s: %s", rr.Region, rr.Error))
+		}
+		for _, vr := range rr.Volumes {
+			if vr.failed() {
+				failures = append(failures, fmt.Sprintf("%s %s: %s", rr.Region, vr.VolumeID, vr.Error))
+			}
+		}
+	}
+	return failures
+}
+
+// err summarizes the failures as an error, or returns nil if there were none.
+func (r *runReport) err() error {
+	failures := r.failures()
+	if len(failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("encountered %d failures: %s", len(failures), strings.Join(failures, "; "))
+}
+
+func (r *runReport) finish() {
+	r.FinishedAt = time.Now()
+	sort.Slice(r.Regions, func(i, j int) bool {
+		return r.Regions[i].Region < r.Regions[j].Region
+	})
+	r.Failures = r.failures()
+}
+
+// logRecap prints a human-readable summary of the report.
+func (r *runReport) logRecap() {
+	log.Println("####### BEGIN FINAL RECAP #######")
+	for _, rr := range r.Regions {
+		for _, n := range rr.Notes {
+			log.Printf("%s %s\n", rr.Region, n)
+		}
+		for _, vr := range rr.Volumes {
+			if vr.Action == ActionSkipped {
+				continue
+			}
+			log.Printf("%s %s %s %s %s\n", rr.Region, vr.VolumeID, vr.Action, vr.Reason, vr.Error)
+		}
+	}
+	log.Printf("Totals: %+v\n", r.Totals)
+
+	if failures := r.failures(); len(failures) > 0 {
+		log.Printf("####### %d FAILURES #######\n", len(failures))
+		for _, f := range failures {
+			log.Println(f)
+		}
+	}
+}
+
+// write persists the report as JSON to the given file, or to stdout when the
+// path is "-".
+func (r *runReport) write(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if path == "-" {
+		_, err = fmt.Fprintln(os.Stdout, string(data))
+		return err
+	}
+	log.Println("Writing the run report to", path)
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunReportFinish(t *testing.T) {
+	r := &runReport{}
+	r.finish()
+	if r.Failures != nil || r.err() != nil {
+		t.Errorf("failures %v and error %v without any failure", r.Failures, r.err())
+	}
+
+	r = &runReport{}
+	r.addError("couldn't load the pricing")
+	r.addRegion(&regionReport{Region: "us-west-2", Error: "access denied"})
+	r.addRegion(&regionReport{Region: "eu-west-1", Volumes: []*volumeReport{
+		{VolumeID: "vol-a", Action: ActionFailed, Error: "throttled"},
+		{VolumeID: "vol-b", Action: ActionSkipped},
+	}})
+	r.finish()
+
+	want := []string{
+		"couldn't load the pricing",
+		"eu-west-1 vol-a: throttled",
+		"us-west-2: access denied",
+	}
+	if strings.Join(r.Failures, "\n") != strings.Join(want, "\n") {
+		t.Errorf("failures %q, want %q", r.Failures, want)
+	}
+	if err := r.err(); err == nil || !strings.Contains(err.Error(), "3 failures") {
+		t.Errorf("expected an error summarizing 3 failures, got %v", err)
+	}
+}
@@ -22,11 +22,28 @@ func (e *EBSOptimizer) Init(cfg *Config) {
 	e.mainEC2Conn = e.connectEC2(e.config.MainRegion)
 	eo = e
 
-	err := populateEBSPricing()
+	err := loadPricing(e.config)
 
 	if err != nil {
 		log.Fatalf("failed to get EBS pricing information: %v", err)
 	}
+
+	if err := setupBackupStore(e.config); err != nil {
+		log.Fatalf("failed to set up the backup store: %v", err)
+	}
+
+	if err := loadCapabilityOverrides(e.config.CapabilitiesFile); err != nil {
+		log.Fatalf("failed to load the volume capabilities: %v", err)
+	}
+
+	if err := loadSchedule(e.config); err != nil {
+		log.Fatalf("failed to load the maintenance schedule: %v", err)
+	}
+
+	// in validate mode the problems of the policy file are reported instead
+	if err := loadPolicy(e.config.PolicyFile); err != nil && e.config.Mode != ModeValidate {
+		log.Fatalf("failed to load the policy: %v", err)
+	}
 }
 
 func (e *EBSOptimizer) connectEC2(region string) *ec2.Client {
@@ -41,23 +58,66 @@ func (e *EBSOptimizer) connectEC2(region string) *ec2.Client {
 	return ec2.NewFromConfig(cfg)
 }
 
-func (e *EBSOptimizer) run(event *json.RawMessage) {
+func (e *EBSOptimizer) run(event *json.RawMessage) *runReport {
+
+	// the event data only overrides the configuration for the current execution
+	savedConfig := *e.config
+	defer func() { *e.config = savedConfig }()
+
+	e.config.applyEvent(event)
+
+	e.config.RunID = newRunID()
+	report := newRunReport(e.config)
+
+	filter, err := newVolumeFilter(e.config)
+	if err != nil {
+		log.Println("Invalid tag filters:", err.Error())
+		report.addError("invalid tag filters: %s", err.Error())
+		return report
+	}
+	e.filter = filter
+
+	// validating the policy doesn't need access to the regions
+	if e.config.Mode == ModeValidate {
+		e.validatePolicy(report)
+		return report
+	}
+
 	allRegions, err := e.getRegions()
 
 	if err != nil {
 		log.Println(err.Error())
-		return
+		report.addError("couldn't list the regions: %s", err.Error())
+		return report
 	}
 
-	e.processRegions(allRegions)
-
-	// Print Final Recap
-	log.Println("####### BEGIN FINAL RECAP #######")
-	for r, a := range e.config.FinalRecap {
-		for _, t := range a {
-			log.Printf("%s %s\n", r, t)
+	switch e.config.Mode {
+	case ModeOptimize:
+		e.processRegions(allRegions, report)
+	case ModePlan:
+		e.processRegions(allRegions, report)
+		if err := newPlan(report).write(e.config.PlanFile); err != nil {
+			log.Println("Couldn't write the plan:", err.Error())
+			report.addError("couldn't write the plan: %s", err.Error())
 		}
+	case ModeApply:
+		e.applyPlan(report)
+	case ModeHistory:
+		e.printHistory(allRegions, report)
+	case ModeRollback:
+		if e.config.RollbackTo != RollbackToInitial && e.config.RollbackTo != RollbackToPrevious {
+			log.Printf("Unknown rollback target %q, nothing to do", e.config.RollbackTo)
+			report.addError("unknown rollback target %q", e.config.RollbackTo)
+			return report
+		}
+		e.rollbackRegions(allRegions, report)
+	default:
+		log.Printf("Unknown mode %q, nothing to do", e.config.Mode)
+		report.addError("unknown mode %q", e.config.Mode)
+		return report
 	}
+
+	return report
 }
 
 // getRegions generates a list of AWS regions.
@@ -85,10 +145,10 @@ func (e *EBSOptimizer) getRegions() ([]string, error) {
 	return output, nil
 }
 
-// processAllRegions iterates all regions in parallel, and replaces instances
-// for each of the ASGs tagged with tags as specified by slice represented by cfg.FilterByTags
-// by default this is all asg with the tag 'spot-enabled=true'.
-func (e *EBSOptimizer) processRegions(regions []string) {
+// processRegions iterates all regions in parallel, scanning their volumes once
+// to calculate the savings and to convert the volumes from the enabled regions
+// to their optimal configuration.
+func (e *EBSOptimizer) processRegions(regions []string, report *runReport) {
 	var wg sync.WaitGroup
 	var mutex sync.Mutex
 	var savings float64
@@ -97,62 +157,76 @@ func (e *EBSOptimizer) processRegions(regions []string) {
 
 		wg.Add(1)
 
-		r := region{name: reg, conf: e.config}
+		r := region{name: reg, conf: e.config, filter: e.filter, report: &regionReport{Region: reg}}
 
 		go func() {
+			defer wg.Done()
 
 			debug.Println("Creating connections to the required AWS services in", r.name)
 			r.api.connect(r.name, r.conf.MainRegion)
-			r.scanEBSVolumes()
+			logCapabilities(r.name)
+
+			if err := r.processEBSVolumes(); err != nil {
+				log.Printf("Failed processing volumes in %s: %s", r.name, err.Error())
+				r.report.Error = err.Error()
+			}
 
-			r.calculateHourlySavings()
 			if r.savings > 0 {
 				log.Printf("Calculated savings in %s: $%f(monthly), %f(hourly) ", r.name, r.savings*730, r.savings)
 			}
+			r.reportMissingPricing()
 
 			mutex.Lock()
 			savings += r.savings
 			mutex.Unlock()
-
-			wg.Done()
+			report.addRegion(r.report)
 		}()
 	}
 	wg.Wait()
 
 	log.Printf("Total savings: %f(monthly), %f(hourly)", savings*730, savings)
 
-	if strings.Contains(e.config.Version, "stable") {
+	if e.config.Mode == ModePlan {
+		log.Println("Running in plan mode, skipped AWS marketplace metering")
+	} else if strings.Contains(e.config.Version, "stable") {
 		log.Println("Running a stable build, submitting AWS marketplace metering data")
 		if err := meterMarketplaceUsage(savings); err != nil {
-			log.Println("Failed marketplace metering, exiting... Encountered error:", err.Error())
+			log.Println("Failed marketplace metering, encountered error:", err.Error())
+			report.addError("failed marketplace metering: %s", err.Error())
 			return
 		}
 	} else {
 		log.Println("Not running a stable build, skipped AWS marketplace metering")
 	}
+}
+
+// rollbackRegions iterates all enabled regions in parallel, and restores the
+// volumes to the configuration backed up in their tags.
+func (e *EBSOptimizer) rollbackRegions(regions []string, report *runReport) {
+	var wg sync.WaitGroup
 
 	for _, reg := range regions {
 
+		r := region{name: reg, conf: e.config, filter: e.filter, report: &regionReport{Region: reg}}
+
+		if !r.enabled() {
+			debug.Println("Not enabled to run in", r.name)
+			continue
+		}
+
 		wg.Add(1)
-		r := region{name: reg, conf: e.config}
 
 		go func() {
+			defer wg.Done()
 
-			debug.Println("Creating connections to the required AWS services in", r.name)
+			log.Printf("Enabled to run in %s, rolling back volumes to the %s configuration.\n", r.name, r.conf.RollbackTo)
 			r.api.connect(r.name, r.conf.MainRegion)
-			r.scanEBSVolumes()
-
-			if r.enabled() {
-				log.Printf("Enabled to run in %s, processing region.\n", r.name)
-				r.processEBSVolumes()
-			} else {
-				debug.Println("Not enabled to run in", r.name)
-				debug.Println("List of enabled regions:", r.conf.Regions)
+			if err := r.rollbackEBSVolumes(); err != nil {
+				log.Printf("Failed rolling back volumes in %s: %s", r.name, err.Error())
+				r.report.Error = err.Error()
 			}
-
-			wg.Done()
+			report.addRegion(r.report)
 		}()
 	}
 	wg.Wait()
-
 }
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	// the time zones of the maintenance windows are also needed on Lambda,
+	// where the system time zone database may be missing
+	_ "time/tzdata"
+)
+
+// scheduleSearchLimit bounds the number of windows and blackout periods
+// skipped while searching for the next time a volume can be modified.
+const scheduleSearchLimit = 1000
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// maintenanceWindow is a recurring time range in which the volumes can be
+// modified, given as '<days> <HH:MM>-<HH:MM> [<time zone>]', where the days
+// are '*', a weekday such as 'Sat', a range such as 'Mon-Fri' or a comma
+// separated list of them. Time ranges ending before they start continue on
+// the following day, and the time zone defaults to UTC.
+type maintenanceWindow struct {
+	days     [7]bool
+	start    time.Duration
+	duration time.Duration
+	location *time.Location
+}
+
+// blackoutPeriod is a time range in which no volume is modified, such as a
+// change freeze.
+type blackoutPeriod struct {
+	Summary string    `json:"summary"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+}
+
+// maintenanceWindows are the windows applying to the volumes without their
+// own windows in the MaintenanceWindowTag. Without any window, the volumes
+// can be modified at any time outside the blackout periods.
+var maintenanceWindows []maintenanceWindow
+
+// blackoutPeriods are loaded from the blackout calendar.
+var blackoutPeriods []blackoutPeriod
+
+// parseMaintenanceWindows parses a list of windows separated by semicolons.
+func parseMaintenanceWindows(s string) ([]maintenanceWindow, error) {
+	var windows []maintenanceWindow
+
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		w, err := parseMaintenanceWindow(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q: %w", item, err)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseMaintenanceWindow(s string) (maintenanceWindow, error) {
+	w := maintenanceWindow{location: time.UTC}
+
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return w, fmt.Errorf("expected '<days> <HH:MM>-<HH:MM> [<time zone>]'")
+	}
+
+	if err := w.parseDays(fields[0]); err != nil {
+		return w, err
+	}
+
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return w, fmt.Errorf("invalid time range %q", fields[1])
+	}
+	start, err := parseTimeOfDay(times[0])
+	if err != nil {
+		return w, err
+	}
+	end, err := parseTimeOfDay(times[1])
+	if err != nil {
+		return w, err
+	}
+	w.start, w.duration = start, end-start
+	if end <= start {
+		w.duration += 24 * time.Hour
+	}
+
+	if len(fields) == 3 {
+		loc, err := time.LoadLocation(fields[2])
+		if err != nil {
+			return w, err
+		}
+		w.location = loc
+	}
+	return w, nil
+}
+
+func (w *maintenanceWindow) parseDays(s string) error {
+	if s == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+
+		first, found := weekdays[strings.ToLower(bounds[0])]
+		if !found {
+			return fmt.Errorf("invalid weekday %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, found = weekdays[strings.ToLower(bounds[1])]; !found {
+				return fmt.Errorf("invalid weekday %q", bounds[1])
+			}
+		}
+
+		// ranges such as Fri-Mon wrap around the end of the week
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseTimeOfDay parses HH:MM into the time since midnight, accepting 24:00.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	hm := strings.SplitN(s, ":", 2)
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	h, errH := strconv.Atoi(hm[0])
+	m, errM := strconv.Atoi(hm[1])
+	if errH != nil || errM != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// next returns t if it's inside the window, or else the following start of
+// the window.
+func (w *maintenanceWindow) next(t time.Time) time.Time {
+	local := t.In(w.location)
+	var next time.Time
+
+	// starting from the previous day, whose window may continue on this day
+	for offset := -1; offset <= 7; offset++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, w.location)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(),
+			int(w.start/time.Hour), int(w.start%time.Hour/time.Minute), 0, 0, w.location)
+		end := start.Add(w.duration)
+
+		if !t.Before(start) && t.Before(end) {
+			return t
+		}
+		if start.After(t) && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+	}
+	return next
+}
+
+// loadSchedule parses the global maintenance windows and loads the blackout
+// periods from the blackout calendar.
+func loadSchedule(c *Config) error {
+	windows, err := parseMaintenanceWindows(c.MaintenanceWindows)
+	if err != nil {
+		return err
+	}
+	maintenanceWindows = windows
+
+	if c.BlackoutCalendar == "" {
+		return nil
+	}
+	periods, err := loadBlackoutCalendar(c.BlackoutCalendar)
+	if err != nil {
+		return err
+	}
+	log.Printf("Loaded %d blackout periods from %s\n", len(periods), c.BlackoutCalendar)
+	blackoutPeriods = periods
+	return nil
+}
+
+// windows returns the maintenance windows of the volume, which are those of
+// its MaintenanceWindowTag if it has one, or the global ones.
+func (v *EBSVolume) windows() ([]maintenanceWindow, error) {
+	value, found := tagValue(v.Tags, MaintenanceWindowTag)
+	if !found {
+		return maintenanceWindows, nil
+	}
+	windows, err := parseMaintenanceWindows(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s tag: %w", MaintenanceWindowTag, err)
+	}
+	return windows, nil
+}
+
+// nextWindow returns the earliest time from t at which the volume can be
+// modified, inside one of its maintenance windows and outside the blackout
+// periods, along with the reason why it can't be modified at t.
+func (v *EBSVolume) nextWindow(t time.Time) (time.Time, string, error) {
+	windows, err := v.windows()
+	if err != nil {
+		return t, "", err
+	}
+
+	reason := ""
+	for i := 0; i < scheduleSearchLimit; i++ {
+		if b := blackoutAt(t); b != nil {
+			if reason == "" {
+				reason = fmt.Sprintf("in the blackout period %q", b.Summary)
+			}
+			t = b.End
+			continue
+		}
+
+		if len(windows) == 0 {
+			return t, reason, nil
+		}
+		var next time.Time
+		for j := range windows {
+			if n := windows[j].next(t); !n.IsZero() && (next.IsZero() || n.Before(next)) {
+				next = n
+			}
+		}
+		if next.IsZero() {
+			return t, "", fmt.Errorf("no maintenance window")
+		}
+		if next.Equal(t) {
+			return t, reason, nil
+		}
+		if reason == "" {
+			reason = "outside the maintenance windows"
+		}
+		t = next
+	}
+	return t, "", fmt.Errorf("no maintenance window outside the blackout periods")
+}
+
+// blackoutAt returns the blackout period containing t, if any.
+func blackoutAt(t time.Time) *blackoutPeriod {
+	for i := range blackoutPeriods {
+		b := &blackoutPeriods[i]
+		if !t.Before(b.Start) && t.Before(b.End) {
+			return b
+		}
+	}
+	return nil
+}
+
+// eligibility returns when the volume can be modified, considering its
+// modification cooldown, its maintenance windows and the blackout periods,
+// along with the reason why it can't be modified right away.
+func (v *EBSVolume) eligibility() (time.Time, string, error) {
+	now := time.Now()
+	t, reason := now, ""
+
+	if end, inCooldown := v.cooldownEnd(); inCooldown {
+		t, reason = end, "in the modification cooldown"
+	}
+
+	at, windowReason, err := v.nextWindow(t)
+	if err != nil {
+		return now, "", err
+	}
+	switch {
+	case reason == "":
+		reason = windowReason
+	case windowReason != "":
+		reason += ", then " + windowReason
+	}
+	return at, reason, nil
+}
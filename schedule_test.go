@@ -0,0 +1,215 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func mustParseTime(t *testing.T, s string) time.Time {
+	t.Helper()
+	tm, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	tests := []struct {
+		text     string
+		days     string
+		start    time.Duration
+		duration time.Duration
+		location string
+	}{
+		{"Sat 02:00-06:00", "Sat", 2 * time.Hour, 4 * time.Hour, "UTC"},
+		{"* 00:00-24:00", "Sun,Mon,Tue,Wed,Thu,Fri,Sat", 0, 24 * time.Hour, "UTC"},
+		{"mon-fri 09:30-17:00", "Mon,Tue,Wed,Thu,Fri", 9*time.Hour + 30*time.Minute, 7*time.Hour + 30*time.Minute, "UTC"},
+		{"Fri-Mon 01:00-02:00", "Sun,Mon,Fri,Sat", time.Hour, time.Hour, "UTC"},
+		{"Tue,Thu,Sat-Sun 01:00-02:00", "Sun,Tue,Thu,Sat", time.Hour, time.Hour, "UTC"},
+		{"Sat 22:00-02:00 Europe/Berlin", "Sat", 22 * time.Hour, 4 * time.Hour, "Europe/Berlin"},
+		{"Sun 03:00-03:00 America/New_York", "Sun", 3 * time.Hour, 24 * time.Hour, "America/New_York"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			w, err := parseMaintenanceWindow(tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var days []string
+			for d, enabled := range w.days {
+				if enabled {
+					days = append(days, time.Weekday(d).String()[:3])
+				}
+			}
+			if got := strings.Join(days, ","); got != tt.days {
+				t.Errorf("days %s, want %s", got, tt.days)
+			}
+			if w.start != tt.start || w.duration != tt.duration {
+				t.Errorf("starting at %s for %s, want %s for %s", w.start, w.duration, tt.start, tt.duration)
+			}
+			if w.location.String() != tt.location {
+				t.Errorf("time zone %s, want %s", w.location, tt.location)
+			}
+		})
+	}
+}
+
+func TestParseMaintenanceWindowErrors(t *testing.T) {
+	tests := []string{
+		"Sat",
+		"Sat 02:00-06:00 UTC extra",
+		"Caturday 02:00-06:00",
+		"Mon-Someday 02:00-06:00",
+		"Sat 02:00",
+		"Sat 2-6",
+		"Sat 02:00-24:01",
+		"Sat 02:60-06:00",
+		"Sat -01:00-06:00",
+		"Sat 02:00-06:00 Mars/Olympus_Mons",
+	}
+
+	for _, text := range tests {
+		t.Run(text, func(t *testing.T) {
+			if _, err := parseMaintenanceWindow(text); err == nil {
+				t.Errorf("parsed %q without errors", text)
+			}
+		})
+	}
+}
+
+func TestParseMaintenanceWindows(t *testing.T) {
+	windows, err := parseMaintenanceWindows(" Sat 02:00-06:00 ; Sun 03:00-05:00 Europe/Paris; ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 2 {
+		t.Errorf("parsed %d windows, want 2", len(windows))
+	}
+
+	if windows, err := parseMaintenanceWindows(""); err != nil || len(windows) != 0 {
+		t.Errorf("parsed %d windows and error %v from an empty list", len(windows), err)
+	}
+
+	_, err = parseMaintenanceWindows("Sat 02:00-06:00; Sun 3am")
+	if err == nil || !strings.Contains(err.Error(), `"Sun 3am"`) {
+		t.Errorf("expected an error about the second window, got %v", err)
+	}
+}
+
+func TestMaintenanceWindowNext(t *testing.T) {
+	tests := []struct {
+		name   string
+		window string
+		t      string
+		want   string
+	}{
+		{"inside", "Sat 02:00-06:00", "2026-10-17T03:00:00Z", "2026-10-17T03:00:00Z"},
+		{"at the start", "Sat 02:00-06:00", "2026-10-17T02:00:00Z", "2026-10-17T02:00:00Z"},
+		{"at the end", "Sat 02:00-06:00", "2026-10-17T06:00:00Z", "2026-10-24T02:00:00Z"},
+		{"before", "Sat 02:00-06:00", "2026-10-16T10:00:00Z", "2026-10-17T02:00:00Z"},
+		{"next day", "* 02:00-06:00", "2026-10-17T07:00:00Z", "2026-10-18T02:00:00Z"},
+		{"weekday range", "Mon-Fri 09:00-17:00", "2026-10-17T10:00:00Z", "2026-10-19T09:00:00Z"},
+		{"range wrapping around the week", "Fri-Mon 09:00-17:00", "2026-10-20T10:00:00Z", "2026-10-23T09:00:00Z"},
+
+		{"crossing midnight, before midnight", "Fri 22:00-02:00", "2026-10-16T23:00:00Z", "2026-10-16T23:00:00Z"},
+		{"crossing midnight, after midnight", "Fri 22:00-02:00", "2026-10-17T01:30:00Z", "2026-10-17T01:30:00Z"},
+		{"crossing midnight, at the end", "Fri 22:00-02:00", "2026-10-17T02:00:00Z", "2026-10-23T22:00:00Z"},
+		{"crossing midnight, before the start", "Fri 22:00-02:00", "2026-10-16T21:00:00Z", "2026-10-16T22:00:00Z"},
+		{"crossing midnight at the end of the week", "Sat 23:00-01:00", "2026-10-18T00:30:00Z", "2026-10-18T00:30:00Z"},
+
+		{"time zone ahead of UTC", "Sat 02:00-06:00 Europe/Berlin", "2026-10-16T12:00:00Z", "2026-10-17T00:00:00Z"},
+		{"time zone behind UTC", "Sat 02:00-06:00 America/New_York", "2026-10-17T05:00:00Z", "2026-10-17T06:00:00Z"},
+		{"different weekday in UTC", "Mon 01:00-02:00 Asia/Tokyo", "2026-10-18T12:00:00Z", "2026-10-18T16:00:00Z"},
+
+		// the clocks go forward on 2026-03-29 and back on 2026-10-25 in Berlin
+		{"before the DST start", "Sat 02:00-06:00 Europe/Berlin", "2026-03-22T00:00:00Z", "2026-03-28T01:00:00Z"},
+		{"after the DST start", "Sat 02:00-06:00 Europe/Berlin", "2026-03-29T00:00:00Z", "2026-04-04T00:00:00Z"},
+		{"on the DST start", "Sun 04:00-05:00 Europe/Berlin", "2026-03-28T12:00:00Z", "2026-03-29T02:00:00Z"},
+		{"on the DST end", "Sun 04:00-05:00 Europe/Berlin", "2026-10-24T12:00:00Z", "2026-10-25T03:00:00Z"},
+		{"before the DST end", "Sun 01:00-02:00 Europe/Berlin", "2026-10-24T12:00:00Z", "2026-10-24T23:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseMaintenanceWindow(tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := w.next(mustParseTime(t, tt.t))
+			if want := mustParseTime(t, tt.want); !got.Equal(want) {
+				t.Errorf("next(%s) = %s, want %s", tt.t, got.UTC().Format(time.RFC3339), tt.want)
+			}
+		})
+	}
+}
+
+func TestNextWindow(t *testing.T) {
+	savedWindows, savedPeriods := maintenanceWindows, blackoutPeriods
+	t.Cleanup(func() { maintenanceWindows, blackoutPeriods = savedWindows, savedPeriods })
+
+	freeze := blackoutPeriod{
+		Summary: "freeze",
+		Start:   mustParseTime(t, "2026-10-16T00:00:00Z"),
+		End:     mustParseTime(t, "2026-10-19T00:00:00Z"),
+	}
+
+	tests := []struct {
+		name       string
+		windows    string
+		blackouts  []blackoutPeriod
+		tag        string
+		t          string
+		want       string
+		wantReason string
+	}{
+		{"anytime", "", nil, "", "2026-10-17T03:00:00Z", "2026-10-17T03:00:00Z", ""},
+		{"inside the windows", "Sat 02:00-06:00; Sun 02:00-06:00", nil, "", "2026-10-18T03:00:00Z", "2026-10-18T03:00:00Z", ""},
+		{"earliest of the windows", "Sat 02:00-06:00; Wed 02:00-06:00", nil, "", "2026-10-18T03:00:00Z", "2026-10-21T02:00:00Z", "outside the maintenance windows"},
+		{"blackout without windows", "", []blackoutPeriod{freeze}, "", "2026-10-17T03:00:00Z", "2026-10-19T00:00:00Z", `in the blackout period "freeze"`},
+		{"window inside a blackout", "Sat 02:00-06:00", []blackoutPeriod{freeze}, "", "2026-10-17T03:00:00Z", "2026-10-24T02:00:00Z", `in the blackout period "freeze"`},
+		{"blackout after the next window", "Thu 02:00-06:00", []blackoutPeriod{freeze}, "", "2026-10-14T12:00:00Z", "2026-10-15T02:00:00Z", "outside the maintenance windows"},
+		{"window tag", "Sat 02:00-06:00", nil, "Sun 02:00-06:00", "2026-10-17T03:00:00Z", "2026-10-18T02:00:00Z", "outside the maintenance windows"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			windows, err := parseMaintenanceWindows(tt.windows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			maintenanceWindows, blackoutPeriods = windows, tt.blackouts
+
+			v := testVolume("gp2", 100, 300, 0)
+			if tt.tag != "" {
+				v.Tags = []types.Tag{{Key: aws.String(MaintenanceWindowTag), Value: aws.String(tt.tag)}}
+			}
+
+			got, reason, err := v.nextWindow(mustParseTime(t, tt.t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := mustParseTime(t, tt.want); !got.Equal(want) {
+				t.Errorf("next window at %s, want %s", got.UTC().Format(time.RFC3339), tt.want)
+			}
+			if reason != tt.wantReason {
+				t.Errorf("reason %q, want %q", reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestNextWindowInvalidTag(t *testing.T) {
+	v := testVolume("gp2", 100, 300, 0)
+	v.Tags = []types.Tag{{Key: aws.String(MaintenanceWindowTag), Value: aws.String("Someday 02:00-06:00")}}
+
+	if _, _, err := v.nextWindow(time.Now()); err == nil || !strings.Contains(err.Error(), MaintenanceWindowTag) {
+		t.Errorf("expected an error about the %s tag, got %v", MaintenanceWindowTag, err)
+	}
+}
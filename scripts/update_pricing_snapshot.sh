@@ -0,0 +1,38 @@
+#!/bin/sh
+# Regenerates pricing_snapshot.json, the pricing data embedded in the binary as
+# a last resort, from the Pricing API. It runs the optimizer with an expired
+# pricing cache, which fetches the pricing of all regions and writes it to the
+# cache file in the snapshot format, without touching any volume.
+#
+# Requires AWS credentials allowing pricing:GetProducts and ec2:DescribeRegions.
+#
+# Usage: ./scripts/update_pricing_snapshot.sh
+
+set -eu
+
+cd "$(dirname "$0")/.."
+
+snapshot=pricing_snapshot.json
+cache=$(mktemp -d)/pricing.json
+trap 'rm -rf "$(dirname "$cache")"' EXIT
+
+# the history mode with no enabled region only loads the pricing data
+go run . --mode history --regions none \
+	--pricing_cache_file "$cache" --pricing_cache_ttl 0 >/dev/null || true
+
+# the cache is only written when the Pricing API succeeded
+if [ ! -s "$cache" ]; then
+	echo "Couldn't fetch the pricing data, $snapshot left unchanged" >&2
+	exit 1
+fi
+
+# a partial result would silently disable the volume types in most regions
+for region in us-east-1 eu-west-1 ap-southeast-2 sa-east-1; do
+	if ! grep -q "\"$region\"" "$cache"; then
+		echo "No pricing data for $region, $snapshot left unchanged" >&2
+		exit 1
+	fi
+done
+
+cp "$cache" "$snapshot"
+echo "Updated $snapshot with $(grep -c '"pricePerGB"' "$snapshot") regional prices"
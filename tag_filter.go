@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	// TagFilteringModeOptIn only processes the volumes matching all the tag filters.
+	TagFilteringModeOptIn = "opt-in"
+	// TagFilteringModeOptOut processes all volumes except those matching all the tag filters.
+	TagFilteringModeOptOut = "opt-out"
+)
+
+// tagFilter matches the volume tag with the given key against a glob pattern
+// supporting the '*', '?' and '[...]' wildcards.
+type tagFilter struct {
+	key     string
+	pattern string
+	re      *regexp.Regexp
+}
+
+// volumeFilter decides which volumes are processed, based on their tags.
+type volumeFilter struct {
+	mode    string
+	filters []tagFilter
+}
+
+// newVolumeFilter parses the tag filtering configuration options. When no
+// filters are given it defaults to 'optimize=true' in opt-in mode and to
+// 'optimize=false' in opt-out mode.
+func newVolumeFilter(c *Config) (*volumeFilter, error) {
+	f := volumeFilter{mode: c.TagFilteringMode}
+
+	tags := c.FilterByTags
+
+	switch f.mode {
+	case TagFilteringModeOptIn:
+		if tags == "" {
+			tags = "optimize=true"
+		}
+	case TagFilteringModeOptOut:
+		if tags == "" {
+			tags = "optimize=false"
+		}
+	default:
+		return nil, fmt.Errorf("invalid tag filtering mode %q, expected %s or %s",
+			f.mode, TagFilteringModeOptIn, TagFilteringModeOptOut)
+	}
+
+	filters, err := parseTagFilters(tags)
+	if err != nil {
+		return nil, err
+	}
+	f.filters = filters
+
+	debug.Printf("Using %s tag filters %+v\n", f.mode, f.filters)
+	return &f, nil
+}
+
+// parseTagFilters parses a list of 'key=value' pairs separated by comma. The
+// values may contain glob patterns, and a key given without a value matches
+// any value of that tag.
+func parseTagFilters(s string) ([]tagFilter, error) {
+	var filters []tagFilter
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if key == "" {
+			return nil, fmt.Errorf("invalid tag filter %q: missing tag key", item)
+		}
+
+		pattern := "*"
+		if len(kv) == 2 {
+			pattern = strings.TrimSpace(kv[1])
+		}
+
+		re, err := globToRegexp(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag filter %q: %v", item, err)
+		}
+		filters = append(filters, tagFilter{key: key, pattern: pattern, re: re})
+	}
+	return filters, nil
+}
+
+// globToRegexp converts a glob pattern to an anchored regular expression. As
+// opposed to filepath.Match, the wildcards also match the '/' character, which
+// is commonly used in tag values.
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class in %q", pattern)
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+
+	return regexp.Compile(sb.String())
+}
+
+// ec2Filters translates the tag filters to DescribeVolumes filters, so that
+// the volumes are already filtered on the server side. This is only possible
+// in opt-in mode and for the patterns using the wildcards supported by EC2.
+func (f *volumeFilter) ec2Filters() []types.Filter {
+	var filters []types.Filter
+
+	if f.mode != TagFilteringModeOptIn {
+		return nil
+	}
+
+	for _, tf := range f.filters {
+		if strings.ContainsAny(tf.key, "*?[\\") || strings.ContainsAny(tf.pattern, "[\\") {
+			debug.Printf("Tag filter %s=%s can only be evaluated client-side\n", tf.key, tf.pattern)
+			continue
+		}
+		filters = append(filters, types.Filter{
+			Name:   aws.String("tag:" + tf.key),
+			Values: []string{tf.pattern},
+		})
+	}
+	return filters
+}
+
+// matchesAll checks if the volume tags match all the filters, returning the
+// explanation of the outcome.
+func (f *volumeFilter) matchesAll(tags []types.Tag) (bool, string) {
+	for _, tf := range f.filters {
+		value, found := tagValue(tags, tf.key)
+		if !found {
+			return false, fmt.Sprintf("missing tag %s", tf.key)
+		}
+		if !tf.re.MatchString(value) {
+			return false, fmt.Sprintf("tag %s=%s doesn't match %s", tf.key, value, tf.pattern)
+		}
+	}
+	return true, "all tag filters matched"
+}
+
+// includes evaluates the opt-in or opt-out semantics of the filters against
+// the given volume, returning whether it should be processed and why.
+func (f *volumeFilter) includes(v *EBSVolume) (bool, string) {
+	matched, reason := f.matchesAll(v.Tags)
+
+	if f.mode == TagFilteringModeOptIn {
+		return matched, fmt.Sprintf("opt-in: %s", reason)
+	}
+	return !matched, fmt.Sprintf("opt-out: %s", reason)
+}
+
+func tagValue(tags []types.Tag, key string) (string, bool) {
+	for _, tag := range tags {
+		if tag.Key != nil && *tag.Key == key {
+			return aws.ToString(tag.Value), true
+		}
+	}
+	return "", false
+}
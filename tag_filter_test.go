@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		want    bool
+	}{
+		{"prod", "prod", true},
+		{"prod", "production", false},
+		{"prod*", "production", true},
+		{"*", "", true},
+		{"team/*", "team/data/backup", true},
+		{"db-?", "db-1", true},
+		{"db-?", "db-10", false},
+		{"db-[0-9]", "db-7", true},
+		{"db-[0-9]", "db-x", false},
+		{"db-[!0-9]", "db-x", true},
+		{"db-[!0-9]", "db-7", false},
+		{"v1.0", "v1x0", false},
+		{"a+b", "a+b", true},
+		{`\*`, "*", true},
+		{`\*`, "x", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.value, func(t *testing.T) {
+			re, err := globToRegexp(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := re.MatchString(tt.value); got != tt.want {
+				t.Errorf("%q matched %q: %v, want %v", tt.pattern, tt.value, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := globToRegexp("db-[0-9"); err == nil {
+		t.Error("converted an unterminated character class")
+	}
+}
+
+func TestParseTagFilters(t *testing.T) {
+	filters, err := parseTagFilters(" optimize = true ,team=data-*,,owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct{ key, pattern string }{
+		{"optimize", "true"},
+		{"team", "data-*"},
+		{"owner", "*"},
+	}
+	if len(filters) != len(want) {
+		t.Fatalf("parsed %d filters %+v, want %d", len(filters), filters, len(want))
+	}
+	for i, w := range want {
+		if filters[i].key != w.key || filters[i].pattern != w.pattern {
+			t.Errorf("filter %d is %s=%s, want %s=%s", i, filters[i].key, filters[i].pattern, w.key, w.pattern)
+		}
+	}
+
+	for _, s := range []string{"=true", "team=[a-", " = x"} {
+		if _, err := parseTagFilters(s); err == nil {
+			t.Errorf("parsed the invalid tag filters %q", s)
+		}
+	}
+}
+
+func TestVolumeFilterIncludes(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		filters string
+		tags    []string
+		want    bool
+	}{
+		{"opt-in default matched", TagFilteringModeOptIn, "", []string{"optimize", "true"}, true},
+		{"opt-in default not matched", TagFilteringModeOptIn, "", []string{"optimize", "false"}, false},
+		{"opt-in missing tag", TagFilteringModeOptIn, "", nil, false},
+		{"opt-in all filters matched", TagFilteringModeOptIn, "env=prod*,team", []string{"env", "production", "team", "data"}, true},
+		{"opt-in one filter not matched", TagFilteringModeOptIn, "env=prod*,team", []string{"env", "production"}, false},
+		{"opt-out default matched", TagFilteringModeOptOut, "", []string{"optimize", "false"}, false},
+		{"opt-out missing tag", TagFilteringModeOptOut, "", nil, true},
+		{"opt-out only some filters matched", TagFilteringModeOptOut, "env=dev,team=qa", []string{"env", "dev"}, true},
+		{"opt-out all filters matched", TagFilteringModeOptOut, "env=dev,team=qa", []string{"env", "dev", "team", "qa"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newVolumeFilter(&Config{TagFilteringMode: tt.mode, FilterByTags: tt.filters})
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := testVolume("gp2", 100, 300, 0)
+			v.Tags = tags(tt.tags...)
+
+			got, reason := f.includes(v)
+			if got != tt.want {
+				t.Errorf("included %v (%s), want %v", got, reason, tt.want)
+			}
+			if !strings.HasPrefix(reason, tt.mode+": ") {
+				t.Errorf("reason %q doesn't mention the %s mode", reason, tt.mode)
+			}
+		})
+	}
+
+	if _, err := newVolumeFilter(&Config{TagFilteringMode: "opt-maybe"}); err == nil {
+		t.Error("accepted an invalid tag filtering mode")
+	}
+}
+
+func TestVolumeFilterEC2Filters(t *testing.T) {
+	f, err := newVolumeFilter(&Config{TagFilteringMode: TagFilteringModeOptIn, FilterByTags: "optimize=true,team=data-*,env=[pd]*,owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, filter := range f.ec2Filters() {
+		got = append(got, aws.ToString(filter.Name)+"="+strings.Join(filter.Values, "|"))
+	}
+	// the character classes aren't supported by EC2, so the env filter is
+	// only evaluated on the client side
+	want := "tag:optimize=true,tag:team=data-*,tag:owner=*"
+	if strings.Join(got, ",") != want {
+		t.Errorf("EC2 filters %s, want %s", strings.Join(got, ","), want)
+	}
+
+	f, err = newVolumeFilter(&Config{TagFilteringMode: TagFilteringModeOptOut})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filters := f.ec2Filters(); len(filters) != 0 {
+		t.Errorf("opt-out mode used the EC2 filters %+v", filters)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+)
+
+// overProvisioningThreshold is the share of the provisioned IOPS or throughput
+// under which the usage of a volume is considered over-provisioned.
+const overProvisioningThreshold = 0.5
+
+// utilizationReport compares the provisioned performance of a volume with the
+// performance it needs according to its metrics, along with the configuration
+// of the same type reduced to that need.
+type utilizationReport struct {
+	ProvisionedIOPS       int32 `json:"provisionedIops"`
+	ProvisionedThroughput int32 `json:"provisionedThroughput"`
+	RequiredIOPS          int32 `json:"requiredIops"`
+	RequiredThroughput    int32 `json:"requiredThroughput"`
+	OverProvisioned       bool  `json:"overProvisioned"`
+
+	Reduced        *volumeConfig `json:"reduced,omitempty"`
+	MonthlySavings float64       `json:"monthlySavings"`
+
+	// whether the requirements were lowered to the usage
+	Applied bool `json:"applied"`
+}
+
+// analyzeUtilization flags the volumes with provisioned performance that are
+// using much less of it, and prices the reduction toward their usage. When
+// downsizing is enabled, the requirements are lowered to the usage, so that
+// the decision may pick the reduced configuration or a cheaper type.
+func (pe *performanceEnvelope) analyzeUtilization(v *EBSVolume) {
+	vc := v.getCurrentConfiguration()
+	vi, _ := regionalVolumeInfo(string(vc.VolumeType), v.region)
+
+	u, err := v.usage()
+	if err != nil {
+		log.Printf("Couldn't read the metrics of volume %s in %s: %s\n", *v.VolumeId, v.region, err.Error())
+		return
+	}
+	if u == nil {
+		debug.Printf("Not enough metrics for analyzing the utilization of volume %s in %s\n", *v.VolumeId, v.region)
+		return
+	}
+	pe.Usage = u
+
+	ur := utilizationReport{
+		ProvisionedIOPS:       pe.IOPS,
+		ProvisionedThroughput: pe.Throughput,
+		RequiredIOPS:          min32(u.IOPS, pe.IOPS),
+		RequiredThroughput:    min32(u.Throughput, pe.Throughput),
+	}
+	pe.Utilization = &ur
+
+	underused := float64(u.IOPS) < overProvisioningThreshold*float64(pe.IOPS) ||
+		(vi.configurableThroughput && float64(u.Throughput) < overProvisioningThreshold*float64(pe.Throughput))
+	if !underused {
+		return
+	}
+
+	reduced := *pe
+	reduced.IOPS, reduced.Throughput = ur.RequiredIOPS, ur.RequiredThroughput
+
+	rc, err := reduced.cheapestConfiguration(vi, v.region)
+	if err != nil {
+		debug.Printf("Couldn't reduce volume %s in %s: %s\n", *v.VolumeId, v.region, err.Error())
+		return
+	}
+
+	savings := vc.calculateMonthlyPrice() - rc.calculateMonthlyPrice()
+	if savings <= priceEpsilon {
+		return
+	}
+	ur.OverProvisioned, ur.Reduced, ur.MonthlySavings = true, rc, savings
+
+	log.Printf("Volume %s in %s is over-provisioned: provisioned %d IOPS and %dMiB/s, needs %d IOPS and %dMiB/s, reducing it would save $%.2f/month\n",
+		*v.VolumeId, v.region, ur.ProvisionedIOPS, ur.ProvisionedThroughput, ur.RequiredIOPS, ur.RequiredThroughput, savings)
+
+	if conf.DownsizeOverprovisioned {
+		pe.IOPS, pe.Throughput = reduced.IOPS, reduced.Throughput
+		ur.Applied = true
+	}
+}
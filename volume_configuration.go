@@ -2,8 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 )
 
@@ -21,6 +24,10 @@ func (vc *volumeConfig) calculateMonthlyPrice() float64 {
 
 	debug.Printf("Calculating monthly cost for %v in %s \n", vc, vc.Region)
 
+	if rp.pricePerGB == 0 {
+		log.Printf("Missing pricing information for %s volumes in %s, their cost is unknown\n", vc.VolumeType, vc.Region)
+	}
+
 	// Start with Storage pricing
 
 	monthlyPrice := rp.pricePerGB * float64(vc.Size)
@@ -56,30 +63,80 @@ func (vc *volumeConfig) toString() string {
 	return string(res)
 }
 
-func io2Supports(region string) bool {
-	// this is fugly, I wish we had a better way of checking this.
-	io2SupporedRegions := []string{
-		"us-east-1",
-		"us-east-2",
-		"us-west-1",
-		"us-west-2",
-		"ca-central-1",
-		"eu-central-1",
-		"eu-west-1",
-		"eu-west-2",
-		"eu-north-1",
-		"ap-east-1",
-		"ap-south-1",
-		"ap-southeast-1",
-		"ap-southeast-2",
-		"ap-northeast-1",
-		"ap-northeast-2",
-		"me-south-1",
+// equals compares the volume type and the performance settings that can be
+// configured for it, ignoring the region and size.
+func (vc *volumeConfig) equals(other *volumeConfig) bool {
+	if vc.VolumeType != other.VolumeType {
+		return false
+	}
+	vi := ebsInfo[string(vc.VolumeType)]
+	if vi.configurableIOPS && vc.IOPS != other.IOPS {
+		return false
 	}
-	for _, item := range io2SupporedRegions {
-		if item == region {
-			return true
+	if vi.configurableThroughput && vc.Throughput != other.Throughput {
+		return false
+	}
+	return true
+}
+
+// validate checks the configuration against the limits of its volume type in
+// its region, so that invalid targets are reported before calling the
+// ModifyVolume API.
+func (vc *volumeConfig) validate() error {
+	vi, found := regionalVolumeInfo(string(vc.VolumeType), vc.Region)
+	if !found {
+		return fmt.Errorf("unknown volume type %q", vc.VolumeType)
+	}
+
+	if !supports(vc.Region, vi.name) {
+		return fmt.Errorf("%s volumes are not available in %s", vi.name, vc.Region)
+	}
+
+	if vc.Size < vi.minSizeGB || vc.Size > vi.maxSizeTB*1024 {
+		return fmt.Errorf("%s volumes must be between %dGB and %dTB, got %dGB",
+			vi.name, vi.minSizeGB, vi.maxSizeTB, vc.Size)
+	}
+
+	if vi.configurableIOPS {
+		if vc.IOPS < vi.minIOPS || vc.IOPS > vi.maxIOPS {
+			return fmt.Errorf("%s volumes support between %d and %d IOPS, got %d",
+				vi.name, vi.minIOPS, vi.maxIOPS, vc.IOPS)
 		}
+		// the minimum IOPS are available regardless of the size
+		if vi.maxIOPSPerGB > 0 && vc.IOPS > max32(vi.minIOPS, vi.maxIOPSPerGB*vc.Size) {
+			return fmt.Errorf("%s volumes support at most %d IOPS per GB, got %d IOPS for %dGB",
+				vi.name, vi.maxIOPSPerGB, vc.IOPS, vc.Size)
+		}
+	}
+
+	if vi.configurableThroughput {
+		if vc.Throughput < vi.throughputFree || vc.Throughput > vi.maxThroughput {
+			return fmt.Errorf("%s volumes support between %d and %d MiB/s of throughput, got %d",
+				vi.name, vi.throughputFree, vi.maxThroughput, vc.Throughput)
+		}
+		if vi.maxThroughputPerIOPS > 0 && float64(vc.Throughput) > vi.maxThroughputPerIOPS*float64(vc.IOPS) {
+			return fmt.Errorf("%s volumes support at most %.2f MiB/s of throughput per IOPS, got %d MiB/s for %d IOPS",
+				vi.name, vi.maxThroughputPerIOPS, vc.Throughput, vc.IOPS)
+		}
+	}
+	return nil
+}
+
+// modifyVolumeInput builds the parameters of the ModifyVolume API call that
+// converts the given volume to this configuration. The IOPS and throughput are
+// only passed for the volume types that support setting them.
+func (vc *volumeConfig) modifyVolumeInput(volumeID *string) *ec2.ModifyVolumeInput {
+	input := ec2.ModifyVolumeInput{
+		VolumeId:   volumeID,
+		VolumeType: vc.VolumeType,
+	}
+
+	vi := ebsInfo[string(vc.VolumeType)]
+	if vi.configurableIOPS && vc.IOPS > 0 {
+		input.Iops = aws.Int32(vc.IOPS)
+	}
+	if vi.configurableThroughput && vc.Throughput > 0 {
+		input.Throughput = aws.Int32(vc.Throughput)
 	}
-	return false
+	return &input
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestVolumeConfigValidate(t *testing.T) {
+	tests := []struct {
+		volumeType string
+		size       int32
+		iops       int32
+		throughput int32
+		valid      bool
+	}{
+		// sizes
+		{"gp2", 1, 0, 0, true},
+		{"gp2", 0, 0, 0, false},
+		{"gp2", 16384, 0, 0, true},
+		{"gp2", 16385, 0, 0, false},
+		{"st1", 125, 0, 0, true},
+		{"st1", 124, 0, 0, false},
+		{"st1", 16384, 0, 0, true},
+		{"st1", 16385, 0, 0, false},
+		{"sc1", 125, 0, 0, true},
+		{"sc1", 124, 0, 0, false},
+		{"standard", 1024, 0, 0, true},
+		{"standard", 1025, 0, 0, false},
+		{"io1", 4, 100, 0, true},
+		{"io1", 3, 100, 0, false},
+		{"io2", 4, 100, 0, true},
+		{"io2", 3, 100, 0, false},
+
+		// IOPS range
+		{"gp3", 100, 3000, 125, true},
+		{"gp3", 100, 2999, 125, false},
+		{"gp3", 1000, 16000, 125, true},
+		{"gp3", 1000, 16001, 125, false},
+		{"io1", 100, 100, 0, true},
+		{"io1", 100, 99, 0, false},
+		{"io1", 2000, 64000, 0, true},
+		{"io1", 2000, 64001, 0, false},
+		{"io2", 200, 64000, 0, true},
+		{"io2", 200, 64001, 0, false},
+
+		// IOPS per GB, the minimum IOPS being available at any size
+		{"gp3", 8, 4000, 125, true},
+		{"gp3", 8, 4001, 125, false},
+		{"gp3", 1, 3000, 125, true},
+		{"io1", 100, 5000, 0, true},
+		{"io1", 100, 5001, 0, false},
+		{"io2", 100, 50000, 0, true},
+		{"io2", 100, 50001, 0, false},
+
+		// throughput range and throughput per IOPS
+		{"gp3", 100, 3000, 124, false},
+		{"gp3", 100, 4000, 1000, true},
+		{"gp3", 100, 4000, 1001, false},
+		{"gp3", 100, 3000, 750, true},
+		{"gp3", 100, 3000, 751, false},
+	}
+
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s %dGB %dIOPS %dMiBps", tt.volumeType, tt.size, tt.iops, tt.throughput)
+		t.Run(name, func(t *testing.T) {
+			vc := volumeConfig{
+				VolumeType: types.VolumeType(tt.volumeType),
+				Region:     "us-east-1",
+				Size:       tt.size,
+				IOPS:       tt.iops,
+				Throughput: tt.throughput,
+			}
+			err := vc.validate()
+			if tt.valid && err != nil {
+				t.Errorf("invalid: %s", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("valid, want an error")
+			}
+		})
+	}
+}
+
+func TestVolumeConfigValidateUnknownType(t *testing.T) {
+	vc := volumeConfig{VolumeType: "gp4", Region: "us-east-1", Size: 100}
+	if err := vc.validate(); err == nil {
+		t.Error("validated an unknown volume type")
+	}
+}
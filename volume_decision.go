@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// priceEpsilon is the monthly price difference under which two candidate
+// configurations are considered equally expensive.
+const priceEpsilon = 0.005
+
+// performanceEnvelope describes the minimum characteristics that a target
+// configuration needs to provide in order to replace the current one.
+type performanceEnvelope struct {
+	IOPS       int32
+	Throughput int32
+	Durability float64
+	Bootable   bool
+	SSD        bool
+	Size       int32
+
+	// the usage from the metrics, when the requirements are based on it
+	Usage *volumeUsage
+
+	// the utilization of the volumes with provisioned performance
+	Utilization *utilizationReport
+
+	// the limits of the attached instance, when they lowered the requirements
+	InstanceClamp *instanceClamp
+
+	// the policy rule which adjusted the requirements
+	Policy *policyReport
+
+	// the volume type required by the policy or by the override tags, and the
+	// minimums required by the override tags, which the current configuration
+	// may not meet
+	TargetType    string
+	MinIOPS       int32
+	MinThroughput int32
+}
+
+// candidate is a configuration the volume could be converted to, along with
+// its monthly price in the volume's region.
+type candidate struct {
+	Config       volumeConfig `json:"config"`
+	MonthlyPrice float64      `json:"monthlyPrice"`
+	Current      bool         `json:"current,omitempty"`
+}
+
+// volumeDecision records how the target configuration of a volume was chosen,
+// so that the change can be justified to the owners of the volume.
+type volumeDecision struct {
+	VolumeID     string
+	Current      volumeConfig
+	Target       volumeConfig
+	Requirements performanceEnvelope
+
+	// valid configurations sorted from the cheapest, the first being the target
+	Candidates []candidate
+
+	// volume types that were not considered, with the reason
+	Rejected map[string]string
+}
+
+// performanceEnvelope computes the requirements based on the current volume
+// configuration. The gp2 volumes are only required to get the GP3 baseline
+// performance, unless the gp3_match_gp2_* options are set, or unless sizing
+// based on metrics is enabled and there's enough data about their usage. With
+// metrics, the utilization of the volumes with provisioned performance is also
+// analyzed, and their requirements are lowered if downsizing is enabled. The
+// policy rule matching the volume may then replace the requirements, which
+// are capped by the limits of the attached instance, and finally adjusted by
+// the override tags of the volume.
+func (v *EBSVolume) performanceEnvelope() performanceEnvelope {
+	pe := v.defaultPerformanceEnvelope()
+	vi := ebsInfo[string(v.VolumeType)]
+
+	if conf.MetricsSizing {
+		switch {
+		case v.VolumeType == "gp2":
+			pe.applyUsage(v)
+		case vi.configurableIOPS:
+			pe.analyzeUtilization(v)
+		}
+	}
+
+	// policy lookup errors were already reported when planning
+	if r, err := v.policyRule(); err == nil && r != nil {
+		pe.applyPolicy(v, r)
+	}
+
+	if conf.ClampToInstanceLimits {
+		pe.clampToInstance(v)
+	}
+
+	// invalid overrides were already reported when planning
+	if o, err := v.overrides(); err == nil && o != nil {
+		pe.applyOverrides(o)
+	}
+	return pe
+}
+
+// defaultPerformanceEnvelope computes the requirements based only on the
+// current volume configuration and on the global configuration flags.
+func (v *EBSVolume) defaultPerformanceEnvelope() performanceEnvelope {
+	vc := v.getCurrentConfiguration()
+	vi := ebsInfo[string(vc.VolumeType)]
+
+	iops, throughput := vi.performance(vc.Size, vc.IOPS)
+	if vi.configurableThroughput {
+		throughput = vc.Throughput
+	}
+
+	if vc.VolumeType == "gp2" {
+		iops = min32(iops, ebsInfo["gp3"].minIOPS)
+		throughput = 0
+
+		if vc.Size > 1000 && conf.GP3MatchGP2IOPS {
+			iops, _ = vi.performance(vc.Size, 0) // match GP2 IOPS for large volumes
+		}
+		if vc.Size > 170 && conf.GP3MatchGP2BurstThroughput {
+			throughput = vi.maxThroughput // match GP2 burstable throughput
+		}
+	}
+
+	pe := performanceEnvelope{
+		IOPS:       iops,
+		Throughput: throughput,
+		Durability: vi.minDurability,
+		Bootable:   v.isBootVolume(),
+		SSD:        !vi.hdd,
+		Size:       vc.Size,
+	}
+	return pe
+}
+
+// applyUsage replaces the performance requirements with the ones derived from
+// the metrics of the volume, keeping them unchanged if they're unavailable.
+func (pe *performanceEnvelope) applyUsage(v *EBSVolume) {
+	u, err := v.usage()
+	if err != nil {
+		log.Printf("Couldn't read the metrics of volume %s in %s: %s\n", *v.VolumeId, v.region, err.Error())
+		return
+	}
+	if u == nil {
+		log.Printf("Not enough metrics for sizing volume %s in %s, keeping the default requirements\n", *v.VolumeId, v.region)
+		return
+	}
+	log.Printf("Sizing volume %s in %s for %d IOPS and %dMiB/s, based on %d metric datapoints\n",
+		*v.VolumeId, v.region, u.IOPS, u.Throughput, u.Datapoints)
+	pe.IOPS, pe.Throughput, pe.Usage = u.IOPS, u.Throughput, u
+}
+
+// cheapestConfiguration returns the cheapest configuration of the given volume
+// type that meets the requirements, or an error explaining why there is none.
+func (pe *performanceEnvelope) cheapestConfiguration(vi volumeInfo, region string) (*volumeConfig, error) {
+
+	if vi.previousGeneration {
+		return nil, fmt.Errorf("previous generation volume type")
+	}
+	if !supports(region, vi.name) {
+		return nil, fmt.Errorf("not available in %s", region)
+	}
+	if rp := vi.Pricing[region]; rp.pricePerGB == 0 {
+		return nil, fmt.Errorf("missing pricing information in %s", region)
+	}
+	if pe.Size < vi.minSizeGB || pe.Size > vi.maxSizeTB*1024 {
+		return nil, fmt.Errorf("size %dGB outside of the supported %dGB-%dTB range", pe.Size, vi.minSizeGB, vi.maxSizeTB)
+	}
+	if vi.minDurability < pe.Durability {
+		return nil, fmt.Errorf("durability %.3f%% lower than %.3f%%", vi.minDurability, pe.Durability)
+	}
+	if pe.Bootable && !vi.bootable {
+		return nil, fmt.Errorf("not bootable")
+	}
+	if pe.SSD && vi.hdd {
+		return nil, fmt.Errorf("HDD-backed volume type for an SSD workload")
+	}
+
+	vc := volumeConfig{
+		VolumeType: types.VolumeType(vi.name),
+		Region:     region,
+		Size:       pe.Size,
+	}
+
+	if vi.configurableIOPS {
+		vc.IOPS = max32(pe.IOPS, vi.minIOPS)
+		if vi.configurableThroughput {
+			vc.Throughput = max32(pe.Throughput, vi.throughputFree)
+		}
+		// raise the IOPS when needed for reaching the required throughput
+		if vi.maxThroughputPerIOPS > 0 && pe.Throughput > 0 {
+			vc.IOPS = max32(vc.IOPS, int32(math.Ceil(float64(pe.Throughput)/vi.maxThroughputPerIOPS)))
+		}
+		if err := vc.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	iops, throughput := vi.performance(vc.Size, vc.IOPS)
+	if vi.configurableThroughput {
+		throughput = vc.Throughput
+	}
+	if !vi.configurableIOPS {
+		vc.IOPS = iops
+	}
+	if iops < pe.IOPS {
+		return nil, fmt.Errorf("delivers %d IOPS, less than the required %d", iops, pe.IOPS)
+	}
+	if throughput < pe.Throughput {
+		return nil, fmt.Errorf("delivers %dMiB/s, less than the required %dMiB/s", throughput, pe.Throughput)
+	}
+
+	return &vc, nil
+}
+
+// decide searches for the cheapest configuration across all the volume types
+// that meets the current performance envelope of the volume. Among equally
+// priced candidates it prefers the more durable one, and then the current
+// configuration, so that volumes are only modified when there is a benefit.
+func (v *EBSVolume) decide() *volumeDecision {
+	return v.decideFor(v.performanceEnvelope())
+}
+
+// decideFor searches for the cheapest configuration meeting the given
+// requirements, among the volume types allowed by the compatibility rules.
+// When a volume type or minimums are required by the policy or the tags, the
+// configurations meeting them are preferred over the current one even if
+// they're more expensive.
+func (v *EBSVolume) decideFor(pe performanceEnvelope) *volumeDecision {
+	current := *v.getCurrentConfiguration()
+
+	d := volumeDecision{
+		VolumeID:     *v.VolumeId,
+		Current:      current,
+		Requirements: pe,
+		Rejected:     make(map[string]string),
+	}
+
+	d.Candidates = append(d.Candidates, candidate{
+		Config:       current,
+		MonthlyPrice: current.calculateMonthlyPrice(),
+		Current:      true,
+	})
+
+	for name := range ebsInfo {
+		if reason := v.incompatibility(name); reason != "" {
+			if types.VolumeType(name) != current.VolumeType {
+				d.Rejected[name] = reason
+			}
+			continue
+		}
+		if pe.TargetType != "" && name != pe.TargetType {
+			if types.VolumeType(name) != current.VolumeType {
+				d.Rejected[name] = fmt.Sprintf("not the required %s volume type", pe.TargetType)
+			}
+			continue
+		}
+		vi, _ := regionalVolumeInfo(name, v.region)
+		vc, err := d.Requirements.cheapestConfiguration(vi, v.region)
+		if err != nil {
+			if types.VolumeType(name) != current.VolumeType {
+				d.Rejected[name] = err.Error()
+			}
+			continue
+		}
+		if vc.equals(&current) {
+			continue
+		}
+		d.Candidates = append(d.Candidates, candidate{
+			Config:       *vc,
+			MonthlyPrice: vc.calculateMonthlyPrice(),
+		})
+	}
+
+	sort.SliceStable(d.Candidates, func(i, j int) bool {
+		a, b := d.Candidates[i], d.Candidates[j]
+		if ta, tb := string(a.Config.VolumeType) == pe.TargetType, string(b.Config.VolumeType) == pe.TargetType; ta != tb {
+			return ta
+		}
+		if ma, mb := pe.meetsMinimums(&a.Config), pe.meetsMinimums(&b.Config); ma != mb {
+			return ma
+		}
+		if math.Abs(a.MonthlyPrice-b.MonthlyPrice) > priceEpsilon {
+			return a.MonthlyPrice < b.MonthlyPrice
+		}
+		da := ebsInfo[string(a.Config.VolumeType)].minDurability
+		db := ebsInfo[string(b.Config.VolumeType)].minDurability
+		if da != db {
+			return da > db
+		}
+		if a.Current != b.Current {
+			return a.Current
+		}
+		return a.Config.VolumeType < b.Config.VolumeType
+	})
+
+	d.Target = d.Candidates[0].Config
+	return &d
+}
+
+// changed returns true if the target differs from the current configuration.
+func (d *volumeDecision) changed() bool {
+	return !d.Current.equals(&d.Target)
+}
+
+// currentPrice returns the monthly price of the current configuration.
+func (d *volumeDecision) currentPrice() float64 {
+	for _, c := range d.Candidates {
+		if c.Current {
+			return c.MonthlyPrice
+		}
+	}
+	return 0
+}
+
+// summary describes the target and the runner-up candidates with their prices.
+func (d *volumeDecision) summary() string {
+	var options []string
+	for i, c := range d.Candidates {
+		label := ""
+		if i == 0 {
+			label = "target "
+		}
+		if c.Current {
+			label += "current "
+		}
+		options = append(options, fmt.Sprintf("%s%s %dIOPS %dMiB/s $%.2f/month",
+			label, c.Config.VolumeType, c.Config.IOPS, c.Config.Throughput, c.MonthlyPrice))
+	}
+	return strings.Join(options, ", ")
+}
+
+func (d *volumeDecision) log() {
+	log.Printf("Decision for %s in %s, requirements %+v: %s\n",
+		d.VolumeID, d.Current.Region, d.Requirements, d.summary())
+	for t, reason := range d.Rejected {
+		debug.Printf("Rejected %s for %s: %s\n", t, d.VolumeID, reason)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import "testing"
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name    string
+		volume  *EBSVolume
+		config  func(c *Config)
+		want    volumeConfig
+		changed bool
+	}{
+		{
+			name:    "gp2 to the gp3 baseline",
+			volume:  testVolume("gp2", 100, 300, 0),
+			want:    volumeConfig{VolumeType: "gp3", Size: 100, IOPS: 3000, Throughput: 125},
+			changed: true,
+		},
+		{
+			name:    "large gp2 to gp3 matching its IOPS",
+			volume:  testVolume("gp2", 2000, 6000, 0),
+			config:  func(c *Config) { c.GP3MatchGP2IOPS = true },
+			want:    volumeConfig{VolumeType: "gp3", Size: 2000, IOPS: 6000, Throughput: 125},
+			changed: true,
+		},
+		{
+			name:    "large gp2 to gp3 matching its burst throughput",
+			volume:  testVolume("gp2", 500, 1500, 0),
+			config:  func(c *Config) { c.GP3MatchGP2BurstThroughput = true },
+			want:    volumeConfig{VolumeType: "gp3", Size: 500, IOPS: 3000, Throughput: 250},
+			changed: true,
+		},
+		{
+			name:    "io1 to the cheaper gp3",
+			volume:  testVolume("io1", 500, 4000, 0),
+			want:    volumeConfig{VolumeType: "gp3", Size: 500, IOPS: 4000, Throughput: 1000},
+			changed: true,
+		},
+		{
+			name:    "io1 above the gp3 limits to the equally priced but more durable io2",
+			volume:  testVolume("io1", 1000, 20000, 0),
+			want:    volumeConfig{VolumeType: "io2", Size: 1000, IOPS: 20000},
+			changed: true,
+		},
+		{
+			name:   "io2 kept over the equally priced but less durable io1",
+			volume: testVolume("io2", 1000, 20000, 0),
+			want:   volumeConfig{VolumeType: "io2", Size: 1000, IOPS: 20000},
+		},
+		{
+			name:   "gp3 baseline kept",
+			volume: testVolume("gp3", 100, 3000, 125),
+			want:   volumeConfig{VolumeType: "gp3", Size: 100, IOPS: 3000, Throughput: 125},
+		},
+		{
+			name:   "st1 kept over the cheaper sc1 delivering fewer IOPS",
+			volume: testVolume("st1", 2048, 500, 0),
+			want:   volumeConfig{VolumeType: "st1", Size: 2048, IOPS: 500},
+		},
+		{
+			name:   "sc1 kept",
+			volume: testVolume("sc1", 2048, 250, 0),
+			want:   volumeConfig{VolumeType: "sc1", Size: 2048, IOPS: 250},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				if tt.config != nil {
+					tt.config(c)
+				}
+			})
+
+			d := tt.volume.decide()
+			want := tt.want
+			want.Region = "us-east-1"
+			if !d.Target.equals(&want) {
+				t.Errorf("target %s, want %s (%s)", d.Target.toString(), want.toString(), d.summary())
+			}
+			if d.changed() != tt.changed {
+				t.Errorf("changed %v, want %v", d.changed(), tt.changed)
+			}
+		})
+	}
+}
+
+// TestDecideForHDD checks the throughput cutoff between sc1 and st1, which are
+// only candidates for the workloads not requiring SSDs. The volume is a gp2
+// one, since the current configuration is always a candidate.
+func TestDecideForHDD(t *testing.T) {
+	// 2TiB of sc1 and st1 deliver 24MiB/s and 80MiB/s
+	tests := []struct {
+		name       string
+		iops       int32
+		throughput int32
+		ssd        bool
+		want       string
+	}{
+		{"within the sc1 baseline", 200, 24, false, "sc1"},
+		{"above the sc1 throughput", 200, 25, false, "st1"},
+		{"above the sc1 IOPS", 300, 24, false, "st1"},
+		{"above the st1 throughput", 200, 81, false, "gp3"},
+		{"SSD workload", 200, 24, true, "gp3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := testVolume("gp2", 2048, 6144, 0)
+			pe := v.defaultPerformanceEnvelope()
+			pe.IOPS, pe.Throughput, pe.SSD = tt.iops, tt.throughput, tt.ssd
+
+			d := v.decideFor(pe)
+			if string(d.Target.VolumeType) != tt.want {
+				t.Errorf("target %s, want %s (%s)", d.Target.toString(), tt.want, d.summary())
+			}
+		})
+	}
+}
+
+// TestDecideForPreferences checks the preferences applied before the price:
+// the required volume type, and then the minimums required by the tags.
+func TestDecideForPreferences(t *testing.T) {
+	tests := []struct {
+		name       string
+		volume     *EBSVolume
+		targetType string
+		minIOPS    int32
+		want       volumeConfig
+	}{
+		{
+			name:       "required volume type even if more expensive",
+			volume:     testVolume("gp2", 100, 300, 0),
+			targetType: "io2",
+			want:       volumeConfig{VolumeType: "io2", Size: 100, IOPS: 300},
+		},
+		{
+			name:    "minimum IOPS above the current configuration",
+			volume:  testVolume("gp3", 100, 3000, 125),
+			minIOPS: 5000,
+			want:    volumeConfig{VolumeType: "gp3", Size: 100, IOPS: 5000, Throughput: 125},
+		},
+		{
+			name:       "required volume type with minimum IOPS",
+			volume:     testVolume("gp2", 100, 300, 0),
+			targetType: "io1",
+			minIOPS:    4000,
+			want:       volumeConfig{VolumeType: "io1", Size: 100, IOPS: 4000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pe := tt.volume.defaultPerformanceEnvelope()
+			pe.TargetType, pe.MinIOPS = tt.targetType, tt.minIOPS
+			pe.IOPS = max32(pe.IOPS, tt.minIOPS)
+
+			d := tt.volume.decideFor(pe)
+			want := tt.want
+			want.Region = "us-east-1"
+			if !d.Target.equals(&want) {
+				t.Errorf("target %s, want %s (%s)", d.Target.toString(), want.toString(), d.summary())
+			}
+		})
+	}
+}
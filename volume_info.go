@@ -3,7 +3,8 @@ package main
 import (
 	"fmt"
 	"log"
-	"strconv"
+	"math"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/pricing/types"
@@ -20,10 +21,24 @@ type volumeInfo struct {
 	Pricing           volumePricing
 	throughputPerMBs  float64
 	throughputFree    int32
+	iopsFree          int32
 	minIOPS           int32
 	baselineIOPSPerGB int32
 	iopsBurst         int32
 	bootable          bool
+
+	// whether the IOPS and throughput can be set when modifying the volume
+	configurableIOPS       bool
+	configurableThroughput bool
+
+	// maximum throughput in MiB/s per provisioned IOPS
+	maxThroughputPerIOPS float64
+
+	// baseline throughput in MiB/s per TB, for the HDD-backed volume types
+	baselineThroughputPerTB int32
+
+	hdd                bool
+	previousGeneration bool
 }
 
 type piopsPrice struct {
@@ -64,11 +79,18 @@ var ebsInfo = map[string]volumeInfo{
 		maxSizeTB:        16,
 		minDurability:    99.8,
 		maxIOPS:          16000,
+		maxIOPSPerGB:     500,
 		maxThroughput:    1000,
 		Pricing:          make(volumePricing),
 		throughputPerMBs: 0.04,
 		throughputFree:   125,
+		iopsFree:         3000,
+		minIOPS:          3000,
 		bootable:         true,
+
+		configurableIOPS:       true,
+		configurableThroughput: true,
+		maxThroughputPerIOPS:   0.25,
 	},
 	"io1": {
 		name:          "io1",
@@ -79,7 +101,11 @@ var ebsInfo = map[string]volumeInfo{
 		maxIOPSPerGB:  50,
 		maxThroughput: 1000,
 		Pricing:       make(volumePricing),
+		minIOPS:       100,
 		bootable:      true,
+
+		configurableIOPS:     true,
+		maxThroughputPerIOPS: 0.25,
 	},
 	"io2": {
 		name:          "io2",
@@ -90,7 +116,11 @@ var ebsInfo = map[string]volumeInfo{
 		maxIOPSPerGB:  500,
 		maxThroughput: 1000,
 		Pricing:       make(volumePricing),
+		minIOPS:       100,
 		bootable:      true,
+
+		configurableIOPS:     true,
+		maxThroughputPerIOPS: 0.25,
 	},
 
 	"st1": {
@@ -104,6 +134,9 @@ var ebsInfo = map[string]volumeInfo{
 		minIOPS:           100,
 		baselineIOPSPerGB: 3,
 		iopsBurst:         3000,
+
+		baselineThroughputPerTB: 40,
+		hdd:                     true,
 	},
 	"sc1": {
 		name:          "sc1",
@@ -114,6 +147,9 @@ var ebsInfo = map[string]volumeInfo{
 		maxThroughput: 250,
 		Pricing:       make(volumePricing),
 		minIOPS:       0,
+
+		baselineThroughputPerTB: 12,
+		hdd:                     true,
 	},
 	"standard": {
 		name:          "standard",
@@ -124,9 +160,34 @@ var ebsInfo = map[string]volumeInfo{
 		maxThroughput: 90,
 		Pricing:       make(volumePricing),
 		minIOPS:       0,
+
+		hdd:                true,
+		previousGeneration: true,
 	},
 }
 
+// performance returns the IOPS and throughput delivered by a volume of this
+// type with the given size and provisioned IOPS.
+func (vi *volumeInfo) performance(size, iops int32) (int32, int32) {
+	switch {
+	case vi.configurableThroughput:
+		// the throughput is provisioned separately
+		return iops, 0
+	case vi.configurableIOPS:
+		return iops, min32(vi.maxThroughput, int32(float64(iops)*vi.maxThroughputPerIOPS))
+	case vi.hdd && vi.baselineThroughputPerTB > 0:
+		return vi.maxIOPS, min32(vi.maxThroughput, vi.baselineThroughputPerTB*size/1024)
+	case vi.baselineIOPSPerGB > 0:
+		iops = max32(vi.minIOPS, min32(vi.maxIOPS, vi.baselineIOPSPerGB*size))
+		// gp2 volumes of up to 170GB have a throughput of 128MiB/s
+		if size <= 170 {
+			return iops, 128
+		}
+		return iops, vi.maxThroughput
+	}
+	return vi.maxIOPS, vi.maxThroughput
+}
+
 func populateEBSPricing() error {
 
 	log.Println("Fetching EBS pricing data...")
@@ -134,31 +195,31 @@ func populateEBSPricing() error {
 	log.Println("Fetching EBS Storage pricing data for all volume types...")
 	err := populateStoragePricing()
 	if err != nil {
-		log.Fatalf("failed to get storage pricing information: %v", err)
+		return fmt.Errorf("failed to get storage pricing information: %w", err)
 	}
 
 	log.Println("Fetching GP3 pIOPS pricing data...")
 	err = populateGP3PIOPSPricing()
 	if err != nil {
-		log.Fatalf("failed to get GP3 PIOPS pricing information: %v", err)
+		return fmt.Errorf("failed to get GP3 PIOPS pricing information: %w", err)
 	}
 
 	log.Println("Fetching GP3 Throughput pricing data...")
 	err = populateGP3PThroughputPricing()
 	if err != nil {
-		log.Fatalf("failed to get GP3 Throughput pricing information: %v", err)
+		return fmt.Errorf("failed to get GP3 Throughput pricing information: %w", err)
 	}
 
 	log.Println("Fetching IO1 pIOPS pricing data...")
 	err = populateIO1IOPSPricing()
 	if err != nil {
-		log.Fatalf("failed to get IO1 PIOPS pricing information: %v", err)
+		return fmt.Errorf("failed to get IO1 PIOPS pricing information: %w", err)
 	}
 
 	log.Println("Fetching IO2 pIOPS pricing data...")
 	err = populateIO2IOPSPricing()
 	if err != nil {
-		log.Fatalf("failed to get IO2 PIOPS pricing information: %v", err)
+		return fmt.Errorf("failed to get IO2 PIOPS pricing information: %w", err)
 	}
 
 	return err
@@ -177,27 +238,17 @@ func populateStoragePricing() error {
 			Value: aws.String("Storage"),
 		},
 	}
-	pd, err := getPricingData(f)
-	if err != nil {
-		return err
-	}
 
-	for _, v := range pd {
-		volumeType := v.Product.Attributes.VolumeAPIName
-		region := getRegion(v.Product.Attributes.Location)
-		pricePerGBStr := v.Terms.OnDemand.SKU.PriceDimensions.Dimension.PricePerUnit.USD
-		pricePerGB, err := strconv.ParseFloat(pricePerGBStr, 64)
+	return populatePricing(f, func(vi volumeInfo, region string, p *Pricing, dims []dimension) {
+		pricePerGB := dims[0].price
+		debug.Printf("%s: %s costs %f \n %#v\n\n", vi.name, region, pricePerGB, p)
 
-		if err != nil {
-			fmt.Printf("failed to convert %s to float", pricePerGBStr)
-		}
-		debug.Printf("%s: %s costs %f \n %#v\n\n", volumeType, region, pricePerGB, v)
-		ebsInfo[volumeType].Pricing[region] = regionalPricing{
-			pricePerGB: pricePerGB,
-		}
-	}
+		rp := vi.Pricing[region]
+		rp.pricePerGB = pricePerGB
+		vi.Pricing[region] = rp
 
-	return nil
+		learnCapabilities(vi, region, p)
+	})
 }
 
 func populateGP3PIOPSPricing() error {
@@ -213,34 +264,7 @@ func populateGP3PIOPSPricing() error {
 			Value: aws.String("System Operation"),
 		},
 	}
-	pd, err := getPricingData(f)
-	if err != nil {
-		return err
-	}
-
-	for _, v := range pd {
-		volumeType := v.Product.Attributes.VolumeAPIName
-		region := getRegion(v.Product.Attributes.Location)
-		priceStr := v.Terms.OnDemand.SKU.PriceDimensions.Dimension.PricePerUnit.USD
-		price, err := strconv.ParseFloat(priceStr, 64)
-
-		if err != nil {
-			fmt.Printf("failed to convert %s to float", priceStr)
-		}
-		debug.Printf("%s: %s PIOPS costs %f \n %#v\n\n", volumeType, region, price, v)
-
-		pl := ebsInfo[volumeType].Pricing[region]
-
-		pl.piopsPrices = append(
-			pl.piopsPrices, piopsPrice{
-				beginRange:    3000,
-				endRange:      16000,
-				pricePerPIOPS: price,
-			})
-		ebsInfo[volumeType].Pricing[region] = pl
-
-	}
-	return nil
+	return populatePricing(f, addPIOPSPricing)
 }
 
 func populateGP3PThroughputPricing() error {
@@ -256,35 +280,21 @@ func populateGP3PThroughputPricing() error {
 			Value: aws.String("Provisioned Throughput"),
 		},
 	}
-	pd, err := getPricingData(f)
-	if err != nil {
-		return err
-	}
-
-	for _, v := range pd {
-		volumeType := v.Product.Attributes.VolumeAPIName
-		region := getRegion(v.Product.Attributes.Location)
-		priceStr := v.Terms.OnDemand.SKU.PriceDimensions.Dimension.PricePerUnit.USD
-		price, err := strconv.ParseFloat(priceStr, 64)
-		price = price / 1024 // the API returns the value in GBps
 
-		if err != nil {
-			fmt.Printf("failed to convert %s to float", priceStr)
+	return populatePricing(f, func(vi volumeInfo, region string, p *Pricing, dims []dimension) {
+		rp := vi.Pricing[region]
+
+		for _, t := range priceTiers(dims, vi.throughputFree, vi.maxThroughput) {
+			p := tputPrice{
+				beginRange:       t.beginRange,
+				endRange:         t.endRange,
+				tputPricePerMBps: t.price,
+			}
+			debug.Printf("Adding %s Throughput configuration in %s %#+v\n", vi.name, region, p)
+			rp.tputPrices = append(rp.tputPrices, p)
 		}
-		debug.Printf("%s: %s Throughput costs %f \n %#v\n\n", volumeType, region, price, v)
-
-		pl := ebsInfo[volumeType].Pricing[region]
-
-		pl.tputPrices = append(
-			pl.tputPrices, tputPrice{
-				beginRange:       125,
-				endRange:         1000,
-				tputPricePerMBps: price,
-			})
-		ebsInfo[volumeType].Pricing[region] = pl
-
-	}
-	return nil
+		vi.Pricing[region] = rp
+	})
 }
 
 func populateIO1IOPSPricing() error {
@@ -300,34 +310,7 @@ func populateIO1IOPSPricing() error {
 			Value: aws.String("System Operation"),
 		},
 	}
-	pd, err := getPricingData(f)
-	if err != nil {
-		return err
-	}
-
-	for _, v := range pd {
-		volumeType := v.Product.Attributes.VolumeAPIName
-		region := getRegion(v.Product.Attributes.Location)
-		priceStr := v.Terms.OnDemand.SKU.PriceDimensions.Dimension.PricePerUnit.USD
-		price, err := strconv.ParseFloat(priceStr, 64)
-
-		if err != nil {
-			fmt.Printf("failed to convert %s to float", priceStr)
-		}
-		debug.Printf("%s: %s PIOPS costs %f \n %#v\n\n", volumeType, region, price, v)
-
-		pl := ebsInfo[volumeType].Pricing[region]
-
-		pl.piopsPrices = append(
-			pl.piopsPrices, piopsPrice{
-				beginRange:    0,
-				endRange:      64000,
-				pricePerPIOPS: price,
-			})
-		ebsInfo[volumeType].Pricing[region] = pl
-
-	}
-	return nil
+	return populatePricing(f, addPIOPSPricing)
 }
 
 func populateIO2IOPSPricing() error {
@@ -343,48 +326,112 @@ func populateIO2IOPSPricing() error {
 			Value: aws.String("System Operation"),
 		},
 	}
-	pd, err := getPricingData(f)
+	return populatePricing(f, addPIOPSPricing)
+}
+
+// io2IOPSTiers maps the pricing groups of the io2 IOPS tiers to their ranges,
+// for the products whose price dimension doesn't report the range of the tier.
+var io2IOPSTiers = map[string]dimension{
+	"EBS IOPS":        {beginRange: 0, endRange: 32000},
+	"EBS IOPS Tier 2": {beginRange: 32000, endRange: 64000},
+	"EBS IOPS Tier 3": {beginRange: 64000, endRange: 256000},
+}
+
+func addPIOPSPricing(vi volumeInfo, region string, p *Pricing, dims []dimension) {
+	rp := vi.Pricing[region]
+
+	tier, found := io2IOPSTiers[p.Product.Attributes.Group]
+	if vi.name == "io2" && found && len(dims) == 1 && dims[0].unbounded() {
+		dims[0].beginRange, dims[0].endRange = tier.beginRange, tier.endRange
+	}
+
+	for _, t := range priceTiers(dims, vi.iopsFree, vi.maxIOPS) {
+		p := piopsPrice{
+			beginRange:    t.beginRange,
+			endRange:      t.endRange,
+			pricePerPIOPS: t.price,
+		}
+		debug.Printf("Adding %s PIOPS configuration in %s %#+v\n", vi.name, region, p)
+		rp.piopsPrices = append(rp.piopsPrices, p)
+	}
+	vi.Pricing[region] = rp
+}
+
+// populatePricing fetches the pricing data of the products matching the given
+// filters, and passes the parsed price dimensions of each of them to fn.
+func populatePricing(filters []types.Filter, fn func(vi volumeInfo, region string, p *Pricing, dims []dimension)) error {
+	pd, err := getPricingData(filters)
 	if err != nil {
 		return err
 	}
 
-	for _, v := range pd {
-		var beginRange, endRange int32
-		volumeType := v.Product.Attributes.VolumeAPIName
-		region := getRegion(v.Product.Attributes.Location)
-		priceStr := v.Terms.OnDemand.SKU.PriceDimensions.Dimension.PricePerUnit.USD
-		price, err := strconv.ParseFloat(priceStr, 64)
-		group := v.Product.Attributes.Group
+	// learn the region codes first, for the products missing the attribute
+	for _, p := range pd {
+		learnRegionCode(p.Product.Attributes.Location, p.Product.Attributes.RegionCode)
+	}
+
+	for i := range pd {
+		p := &pd[i]
+		attrs := p.Product.Attributes
 
+		if attrs.LocationType != "" && attrs.LocationType != "AWS Region" {
+			debug.Printf("Skipping pricing for %s in %s (%s)\n", attrs.VolumeAPIName, attrs.Location, attrs.LocationType)
+			continue
+		}
+
+		vi, found := ebsInfo[attrs.VolumeAPIName]
+		if !found {
+			debug.Printf("Skipping pricing for unknown volume type %q\n", attrs.VolumeAPIName)
+			continue
+		}
+
+		dims, err := p.dimensions()
 		if err != nil {
-			fmt.Printf("failed to convert %s to float", priceStr)
+			log.Printf("Failed to parse the pricing of %s in %s: %s\n", attrs.VolumeAPIName, attrs.Location, err.Error())
+			continue
 		}
-		debug.Printf("Processing pricing info for %s in %s PIOPS costs %f \n\n", volumeType, region, price)
-		debug.Println(v)
-
-		pl := ebsInfo[volumeType].Pricing[region]
-
-		if group == "EBS IOPS Tier 3" {
-			beginRange = 64001
-			endRange = 256000
-		} else if group == "EBS IOPS Tier 2" {
-			beginRange = 32001
-			endRange = 64000
-		} else if group == "EBS IOPS" {
-			endRange = 32000
+
+		region := attrs.RegionCode
+		if region == "" {
+			region = getRegion(attrs.Location)
 		}
+		if region == attrs.Location {
+			debug.Printf("No region code known for the location %q, storing its pricing under its name\n", attrs.Location)
+		}
+		fn(vi, region, p, dims)
+	}
+	return nil
+}
 
-		p := piopsPrice{
-			beginRange:    beginRange,
-			endRange:      endRange,
-			pricePerPIOPS: price,
+type priceTier struct {
+	beginRange, endRange int32
+	price                float64
+}
+
+// priceTiers converts the price dimensions to tiers expressed in the units
+// used by volumeConfig, starting after the free amount included with the volume
+// and capping the unbounded ranges to the maximum supported by the volume type.
+// Prices given per GiBps are converted to MiBps.
+func priceTiers(dims []dimension, free, max int32) []priceTier {
+	var tiers []priceTier
+
+	for _, d := range dims {
+		scale := 1.0
+		if u := strings.ToLower(d.unit); strings.Contains(u, "gibps") || strings.Contains(u, "gbps") {
+			scale = 1024
 		}
-		debug.Printf("Adding IO2 PIOPS configuration %#+v\n", p)
 
-		pl.piopsPrices = append(
-			pl.piopsPrices, p)
-		ebsInfo[volumeType].Pricing[region] = pl
+		begin := math.Max(d.beginRange*scale, float64(free))
+		end := math.Min(d.endRange*scale, float64(max))
+		if end <= begin {
+			continue
+		}
 
+		tiers = append(tiers, priceTier{
+			beginRange: int32(begin),
+			endRange:   int32(end),
+			price:      d.price / scale,
+		})
 	}
-	return nil
+	return tiers
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// volumeOverrides are the settings given by the owners of a volume in its
+// tags, which take precedence over the global configuration for that volume.
+type volumeOverrides struct {
+	TargetType    string `json:"targetType,omitempty"`
+	MinIOPS       int32  `json:"minIops,omitempty"`
+	MinThroughput int32  `json:"minThroughput,omitempty"`
+	Pinned        bool   `json:"pinned,omitempty"`
+}
+
+// overrides parses the override tags of the volume, validating them against
+// the limits of the volume types in its region. It returns nil when the volume
+// has no override tags.
+func (v *EBSVolume) overrides() (*volumeOverrides, error) {
+	var o volumeOverrides
+	found := false
+
+	for _, tag := range v.Tags {
+		key, value := aws.ToString(tag.Key), strings.TrimSpace(aws.ToString(tag.Value))
+
+		var err error
+		switch key {
+		case TargetTypeTag:
+			o.TargetType = value
+		case MinIOPSTag:
+			o.MinIOPS, err = parseOverrideInt(value)
+		case MinThroughputTag:
+			o.MinThroughput, err = parseOverrideInt(value)
+		case PinTag:
+			o.Pinned, err = strconv.ParseBool(value)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s tag %q: %w", key, value, err)
+		}
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
+	if err := o.validate(v.region); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func parseOverrideInt(value string) (int32, error) {
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative value")
+	}
+	return int32(n), nil
+}
+
+// validate checks the overrides against the limits of the required volume
+// type, or of the most performant volume type when none is required.
+func (o *volumeOverrides) validate(region string) error {
+	var maxIOPS, maxThroughput int32
+
+	if o.TargetType != "" {
+		vi, found := regionalVolumeInfo(o.TargetType, region)
+		if !found {
+			return fmt.Errorf("invalid %s tag: unknown volume type %q", TargetTypeTag, o.TargetType)
+		}
+		if vi.previousGeneration {
+			return fmt.Errorf("invalid %s tag: previous generation volume type %q", TargetTypeTag, o.TargetType)
+		}
+		maxIOPS, maxThroughput = vi.maxIOPS, vi.maxThroughput
+	} else {
+		for name := range ebsInfo {
+			vi, _ := regionalVolumeInfo(name, region)
+			maxIOPS, maxThroughput = max32(maxIOPS, vi.maxIOPS), max32(maxThroughput, vi.maxThroughput)
+		}
+	}
+
+	if o.MinIOPS > maxIOPS {
+		return fmt.Errorf("invalid %s tag: %d IOPS above the maximum of %d", MinIOPSTag, o.MinIOPS, maxIOPS)
+	}
+	if o.MinThroughput > maxThroughput {
+		return fmt.Errorf("invalid %s tag: %dMiB/s above the maximum of %dMiB/s", MinThroughputTag, o.MinThroughput, maxThroughput)
+	}
+	return nil
+}
+
+// checkOverrides records the overrides of the volume in its report, and
+// returns false when the volume must be left untouched, because it's pinned
+// or because its override tags are invalid.
+func (v *EBSVolume) checkOverrides(vr *volumeReport) bool {
+	o, err := v.overrides()
+	if err != nil {
+		log.Printf("Volume %s in %s has invalid override tags: %s\n", *v.VolumeId, v.region, err.Error())
+		vr.needsReview(err.Error())
+		return false
+	}
+	vr.Overrides = o
+
+	if o != nil && o.Pinned {
+		log.Printf("Volume %s in %s is pinned, skipping it\n", *v.VolumeId, v.region)
+		vr.skip(fmt.Sprintf("pinned by the %s tag", PinTag))
+		return false
+	}
+	return true
+}
+
+// applyOverrides raises the requirements to the minimums given in the tags,
+// even above the ones lowered by downsizing, by the instance limits or by the
+// policy, and restricts the decision to the required volume type.
+func (pe *performanceEnvelope) applyOverrides(o *volumeOverrides) {
+	pe.IOPS = max32(pe.IOPS, o.MinIOPS)
+	pe.Throughput = max32(pe.Throughput, o.MinThroughput)
+	pe.MinIOPS, pe.MinThroughput = o.MinIOPS, o.MinThroughput
+	if o.TargetType != "" {
+		pe.TargetType = o.TargetType
+	}
+}
+
+// meetsMinimums checks if the configuration delivers the minimums required by
+// the override tags.
+func (pe *performanceEnvelope) meetsMinimums(vc *volumeConfig) bool {
+	iops, throughput := vc.delivered()
+	return iops >= pe.MinIOPS && throughput >= pe.MinThroughput
+}